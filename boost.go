@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	mqttClient "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Timed boost raises the fan speed until the time expires or the boost is cancelled, then
+// the next active request by speed priority sets the speed.  Active boost is kept in state
+// file over restarts.
+
+const (
+	topicBoostSet       = "vallox/boost/set"
+	topicBoostActive    = "vallox/boost/active"
+	topicBoostRemaining = "vallox/boost/remaining"
+	topicBoostSpeed     = "vallox/boost/speed"
+
+	boostInterval = 10 * time.Second
+)
+
+// boostState is the active boost, kept in persistent state
+type boostState struct {
+	Until time.Time `json:"until"`
+	Speed byte      `json:"speed"`
+}
+
+// boostController keeps the timed boost
+type boostController struct {
+	speed    byte
+	duration time.Duration
+	state    *persistentState
+
+	commands chan string
+}
+
+// newBoost creates boost with default speed and duration from config, resuming boost kept in state
+func newBoost(c Config, state *persistentState, discovery map[string][]haEntity) *boostController {
+	b := &boostController{
+		speed:    c.BoostSpeed,
+		duration: c.BoostDuration,
+		state:    state,
+		commands: make(chan string, 10),
+	}
+
+	discovery["switch"] = append(discovery["switch"],
+		haEntity{
+			UniqueId:     "vallox_boost",
+			Name:         "Tehostus",
+			Device:       device,
+			Icon:         "mdi:fan-plus",
+			StateTopic:   topicBoostActive,
+			CommandTopic: topicBoostSet,
+			PayloadOn:    "on",
+			PayloadOff:   "cancel",
+			StateOn:      "true",
+			StateOff:     "false",
+		},
+	)
+	discovery["sensor"] = append(discovery["sensor"],
+		haEntity{
+			UniqueId:          "vallox_boost_remaining",
+			Name:              "Tehostusta jäljellä",
+			Device:            device,
+			DeviceClass:       "duration",
+			StateTopic:        topicBoostRemaining,
+			UnitOfMeasurement: "min",
+		},
+	)
+
+	if state.Boost != nil {
+		logInfo.Printf("resuming boost to speed %d until %v", state.Boost.Speed, state.Boost.Until)
+	}
+	return b
+}
+
+// speedRequest requests boost speed while boost is active
+func (b *boostController) speedRequest() speedRequest {
+	request := speedRequest{source: speedSourceBoost}
+	if b.state.Boost != nil {
+		request.speed = b.state.Boost.Speed
+	}
+	return request
+}
+
+// command handles boost commands: "<duration> [speed]", minutes as plain number,
+// "on" for default duration or "cancel"/"off" to end the boost
+func (b *boostController) command(command string, now time.Time) {
+	fields := strings.Fields(strings.ToLower(command))
+	if len(fields) == 0 || len(fields) > 2 {
+		logError.Printf("invalid boost command %s", command)
+		return
+	}
+
+	if fields[0] == "cancel" || fields[0] == "off" {
+		b.end("cancelled")
+		return
+	}
+
+	duration := b.duration
+	if fields[0] != "on" {
+		if minutes, err := strconv.ParseUint(fields[0], 10, 16); err == nil {
+			duration = time.Duration(minutes) * time.Minute
+		} else if duration, err = time.ParseDuration(fields[0]); err != nil {
+			logError.Printf("invalid boost duration %s", fields[0])
+			return
+		}
+	}
+	if duration <= 0 {
+		b.end("cancelled")
+		return
+	}
+
+	speed := b.speed
+	if len(fields) == 2 {
+		s, err := strconv.ParseUint(fields[1], 10, 8)
+		if err != nil || s < 1 || s > 8 {
+			logError.Printf("invalid boost speed %s", fields[1])
+			return
+		}
+		speed = byte(s)
+	}
+
+	logInfo.Printf("boosting to speed %d for %v", speed, duration)
+	b.state.Boost = &boostState{Until: now.Add(duration), Speed: speed}
+	b.state.dirty = true
+}
+
+// end ends the boost
+func (b *boostController) end(reason string) {
+	if b.state.Boost == nil {
+		return
+	}
+
+	logInfo.Printf("boost %s", reason)
+	b.state.Boost = nil
+	b.state.dirty = true
+}
+
+// update ends expired boost and publishes boost state
+func (b *boostController) update(mqtt publisher, now time.Time) {
+	if b.state.Boost != nil && !now.Before(b.state.Boost.Until) {
+		b.end("expired")
+	}
+
+	remaining := 0.0
+	speed := byte(0)
+	if b.state.Boost != nil {
+		remaining = math.Ceil(b.state.Boost.Until.Sub(now).Minutes())
+		speed = b.state.Boost.Speed
+	}
+
+	go publish(mqtt, topicBoostActive, fmt.Sprint(b.state.Boost != nil))
+	go publish(mqtt, topicBoostRemaining, fmt.Sprint(remaining))
+	go publish(mqtt, topicBoostSpeed, fmt.Sprint(speed))
+}
+
+func (b *boostController) message(mqtt mqttClient.Client, msg mqttClient.Message) {
+	b.commands <- string(msg.Payload())
+}
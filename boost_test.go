@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBoost() *boostController {
+	return newBoost(Config{BoostSpeed: 6, BoostDuration: 30 * time.Minute}, newPersistentState(), make(map[string][]haEntity))
+}
+
+func TestBoostCommand(t *testing.T) {
+	now := time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)
+	active := &boostState{Until: now.Add(10 * time.Minute), Speed: 7}
+
+	tests := []struct {
+		command  string
+		active   *boostState // boost before the command
+		expected *boostState
+	}{
+		{"on", nil, &boostState{Until: now.Add(30 * time.Minute), Speed: 6}},
+		{"45", nil, &boostState{Until: now.Add(45 * time.Minute), Speed: 6}},
+		{"1h30m 8", nil, &boostState{Until: now.Add(90 * time.Minute), Speed: 8}},
+		{"ON 2", nil, &boostState{Until: now.Add(30 * time.Minute), Speed: 2}},
+		{"20", active, &boostState{Until: now.Add(20 * time.Minute), Speed: 6}},
+		{"cancel", active, nil},
+		{"off", active, nil},
+		{"0", active, nil},
+		{"cancel", nil, nil},
+		{"20 9", active, active},
+		{"20 0", active, active},
+		{"soon", active, active},
+		{"", active, active},
+		{"20 5 now", nil, nil},
+	}
+	for _, test := range tests {
+		b := newTestBoost()
+		b.state.Boost = test.active
+		b.command(test.command, now)
+
+		got := b.state.Boost
+		if (got == nil) != (test.expected == nil) || got != nil && *got != *test.expected {
+			t.Errorf("%q: expected boost %+v, got %+v", test.command, test.expected, got)
+		}
+		if changed := got != test.active; changed != b.state.dirty {
+			t.Errorf("%q: expected state dirty %v, got %v", test.command, changed, b.state.dirty)
+		}
+	}
+}
+
+func TestBoostExpiry(t *testing.T) {
+	until := time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		now       time.Time
+		active    string
+		remaining string
+		speed     string
+	}{
+		{until.Add(-10 * time.Minute), "true", "10", "7"},
+		{until.Add(-90 * time.Second), "true", "2", "7"},
+		{until.Add(-time.Second), "true", "1", "7"},
+		{until, "false", "0", "0"},
+		{until.Add(time.Hour), "false", "0", "0"},
+	}
+	for _, test := range tests {
+		b := newTestBoost()
+		b.state.Boost = &boostState{Until: until, Speed: 7}
+		mqtt := &testPublisher{}
+		b.update(mqtt, test.now)
+
+		expected := map[string]string{
+			topicBoostActive:    test.active,
+			topicBoostRemaining: test.remaining,
+			topicBoostSpeed:     test.speed,
+		}
+		for topic, value := range expected {
+			if payloads := mqtt.waitFor(t, topic, 1); payloads[0] != value {
+				t.Errorf("%v before end: expected %s %s, got %s", until.Sub(test.now), topic, value, payloads[0])
+			}
+		}
+		if ended := b.state.Boost == nil; ended != (test.active == "false") || ended != b.state.dirty {
+			t.Errorf("%v before end: expected boost ended %v and saved, got %+v dirty %v", until.Sub(test.now), test.active == "false", b.state.Boost, b.state.dirty)
+		}
+		speed := byte(0)
+		if test.active == "true" {
+			speed = 7
+		}
+		if request := b.speedRequest(); request.speed != speed {
+			t.Errorf("%v before end: expected speed request %d, got %+v", until.Sub(test.now), speed, request)
+		}
+	}
+}
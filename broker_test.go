@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqttClient "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// testBroker is a minimal in-process MQTT 3.1.1 broker for integration tests.  Messages
+// are delivered with QoS 0 and retained messages are kept.
+type testBroker struct {
+	listener net.Listener
+	url      string
+
+	mu       sync.Mutex
+	clients  map[*testBrokerClient]bool
+	retained map[string]*packets.PublishPacket
+}
+
+type testBrokerClient struct {
+	conn    net.Conn
+	mu      sync.Mutex
+	filters map[string]bool
+}
+
+func startTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot start broker: %v", err)
+	}
+
+	b := &testBroker{
+		listener: listener,
+		url:      "tcp://" + listener.Addr().String(),
+		clients:  make(map[*testBrokerClient]bool),
+		retained: make(map[string]*packets.PublishPacket),
+	}
+	go b.accept()
+	return b
+}
+
+func (b *testBroker) close() {
+	b.listener.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		c.conn.Close()
+	}
+}
+
+func (b *testBroker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &testBrokerClient{conn: conn, filters: make(map[string]bool)}
+		b.mu.Lock()
+		b.clients[c] = true
+		b.mu.Unlock()
+		go b.serve(c)
+	}
+}
+
+func (b *testBroker) serve(c *testBrokerClient) {
+	defer func() {
+		c.conn.Close()
+		b.mu.Lock()
+		delete(b.clients, c)
+		b.mu.Unlock()
+	}()
+
+	for {
+		packet, err := packets.ReadPacket(c.conn)
+		if err != nil {
+			return
+		}
+
+		switch p := packet.(type) {
+		case *packets.ConnectPacket:
+			c.write(packets.NewControlPacket(packets.Connack))
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			b.mu.Lock()
+			for _, filter := range p.Topics {
+				c.filters[filter] = true
+				suback.ReturnCodes = append(suback.ReturnCodes, 0)
+			}
+			var retained []*packets.PublishPacket
+			for topic, msg := range b.retained {
+				for _, filter := range p.Topics {
+					if topicMatches(filter, topic) {
+						retained = append(retained, msg)
+						break
+					}
+				}
+			}
+			b.mu.Unlock()
+			c.write(suback)
+			for _, msg := range retained {
+				c.deliver(msg, true)
+			}
+		case *packets.UnsubscribePacket:
+			b.mu.Lock()
+			for _, filter := range p.Topics {
+				delete(c.filters, filter)
+			}
+			b.mu.Unlock()
+			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			unsuback.MessageID = p.MessageID
+			c.write(unsuback)
+		case *packets.PublishPacket:
+			if p.Qos > 0 {
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = p.MessageID
+				c.write(puback)
+			}
+			b.route(p)
+		case *packets.PingreqPacket:
+			c.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+// route delivers message to subscribed clients and keeps it when retained
+func (b *testBroker) route(msg *packets.PublishPacket) {
+	b.mu.Lock()
+	if msg.Retain {
+		if len(msg.Payload) == 0 {
+			delete(b.retained, msg.TopicName)
+		} else {
+			b.retained[msg.TopicName] = msg
+		}
+	}
+	var receivers []*testBrokerClient
+	for c := range b.clients {
+		for filter := range c.filters {
+			if topicMatches(filter, msg.TopicName) {
+				receivers = append(receivers, c)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	for _, c := range receivers {
+		c.deliver(msg, false)
+	}
+}
+
+// waitSubscribed waits until a client has subscribed to filter
+func (b *testBroker) waitSubscribed(t *testing.T, filter string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		for c := range b.clients {
+			if c.filters[filter] {
+				b.mu.Unlock()
+				return
+			}
+		}
+		b.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no subscription to %s", filter)
+}
+
+// connectTestClient connects a paho client to the broker
+func connectTestClient(t *testing.T, broker *testBroker, id string) mqttClient.Client {
+	t.Helper()
+	client := mqttClient.NewClient(mqttClient.NewClientOptions().AddBroker(broker.url).SetClientID(id))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("cannot connect %s: %v", id, token.Error())
+	}
+	return client
+}
+
+func (c *testBrokerClient) deliver(msg *packets.PublishPacket, retained bool) {
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = msg.TopicName
+	publish.Payload = msg.Payload
+	publish.Retain = retained
+	c.write(publish)
+}
+
+func (c *testBrokerClient) write(packet packets.ControlPacket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	packet.Write(c.conn)
+}
+
+// topicMatches returns true when topic matches subscription filter with + and # wildcards
+func topicMatches(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
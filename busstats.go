@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+// Bus statistics make a flaky RS485 adapter visible.  Published every minute are frames
+// seen during the minute, queries without response, speed writes resent before the unit
+// confirmed them and seconds since the latest frame from a mainboard.
+//
+// Checksum and parse errors are not counted: vallox library reads the serial port itself
+// and discards invalid frames without reporting them, so counting them needs support in
+// the library.
+
+const (
+	topicBusFramesPerMinute = "vallox/busStats/framesPerMinute"
+	topicBusQueryTimeouts   = "vallox/busStats/queryTimeouts"
+	topicBusWriteRetries    = "vallox/busStats/writeRetries"
+	topicBusMainboardAge    = "vallox/busStats/lastMainboardFrame"
+
+	busStatsInterval = time.Minute
+	busQueryTimeout  = 5 * time.Second
+
+	// mainboards use addresses 0x11 - 0x1f, panels 0x21 - 0x2f
+	mainboardFirst byte = 0x11
+	mainboardLast  byte = 0x1f
+)
+
+// busStats counts traffic of the bus of one gateway
+type busStats struct {
+	frames         int
+	queryTimeouts  int
+	writeRetries   int
+	mainboardFrame time.Time
+	queries        map[byte]time.Time // queries waiting for response by register
+	speedSent      byte
+	speedConfirmed bool
+}
+
+// statsBus counts queries and speed writes sent to the bus
+type statsBus struct {
+	valloxBus
+	stats *busStats
+}
+
+func (b statsBus) SetSpeed(speed byte) {
+	if !b.stats.speedConfirmed && speed == b.stats.speedSent {
+		b.stats.writeRetries++
+	}
+	b.stats.speedSent = speed
+	b.stats.speedConfirmed = false
+	b.valloxBus.SetSpeed(speed)
+}
+
+func (b statsBus) Query(register byte) {
+	if _, ok := b.stats.queries[register]; !ok {
+		b.stats.queries[register] = time.Now()
+	}
+	b.valloxBus.Query(register)
+}
+
+// newBusStats creates statistics and adds their entities to discovery
+func newBusStats(discovery map[string][]haEntity) *busStats {
+	discovery["sensor"] = append(discovery["sensor"],
+		haEntity{
+			UniqueId:          "vallox_bus_frames_per_minute",
+			Name:              "Väylän viestit minuutissa",
+			Device:            device,
+			EntityCategory:    "diagnostic",
+			Icon:              "mdi:swap-horizontal",
+			StateClass:        "measurement",
+			StateTopic:        topicBusFramesPerMinute,
+			UnitOfMeasurement: "1/min",
+		},
+		haEntity{
+			UniqueId:       "vallox_bus_query_timeouts",
+			Name:           "Väylän vastaamattomat kyselyt",
+			Device:         device,
+			EntityCategory: "diagnostic",
+			Icon:           "mdi:timer-alert-outline",
+			StateClass:     "total_increasing",
+			StateTopic:     topicBusQueryTimeouts,
+		},
+		haEntity{
+			UniqueId:       "vallox_bus_write_retries",
+			Name:           "Väylän kirjoitusten uusinnat",
+			Device:         device,
+			EntityCategory: "diagnostic",
+			Icon:           "mdi:repeat",
+			StateClass:     "total_increasing",
+			StateTopic:     topicBusWriteRetries,
+		},
+		haEntity{
+			UniqueId:          "vallox_bus_last_mainboard_frame",
+			Name:              "Aikaa emolevyn viestistä",
+			Device:            device,
+			EntityCategory:    "diagnostic",
+			DeviceClass:       "duration",
+			StateClass:        "measurement",
+			StateTopic:        topicBusMainboardAge,
+			UnitOfMeasurement: "s",
+		},
+	)
+	return &busStats{queries: make(map[byte]time.Time), speedConfirmed: true}
+}
+
+// recordFrame updates statistics from frame seen on the bus
+func (s *busStats) recordFrame(e vallox.Event, forMe bool, t time.Time) {
+	s.frames++
+	if e.Source >= mainboardFirst && e.Source <= mainboardLast {
+		s.mainboardFrame = t
+	}
+	if !forMe {
+		return
+	}
+	delete(s.queries, e.Register)
+	if e.Register == vallox.RegisterCurrentFanSpeed {
+		if speed, ok := e.Value.(int16); ok && byte(speed) == s.speedSent {
+			s.speedConfirmed = true
+		}
+	}
+}
+
+// publish publishes statistics and starts counting frames for the next interval
+func (s *busStats) publish(mqtt publisher, now time.Time) {
+	for register, sent := range s.queries {
+		if now.Sub(sent) > busQueryTimeout {
+			logDebug.Printf("no response to query of register %x", register)
+			s.queryTimeouts++
+			delete(s.queries, register)
+		}
+	}
+
+	go publish(mqtt, topicBusFramesPerMinute, fmt.Sprintf("%.0f", float64(s.frames)/busStatsInterval.Minutes()))
+	go publish(mqtt, topicBusQueryTimeouts, fmt.Sprint(s.queryTimeouts))
+	go publish(mqtt, topicBusWriteRetries, fmt.Sprint(s.writeRetries))
+	if !s.mainboardFrame.IsZero() {
+		go publish(mqtt, topicBusMainboardAge, fmt.Sprintf("%.0f", now.Sub(s.mainboardFrame).Seconds()))
+	}
+	s.frames = 0
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+func TestBusStats(t *testing.T) {
+	g, bus, mqtt := newTestGateway()
+
+	// one query is answered, the other times out
+	g.device.Query(vallox.RegisterRH1)
+	g.device.Query(vallox.RegisterCurrentCO2)
+
+	// speed is resent before the unit confirms it, the same speed after confirmation is not a retry
+	g.device.SetSpeed(3)
+	g.device.SetSpeed(3)
+
+	frames := []vallox.Event{
+		{Source: 0x11, Destination: testAddress, Register: vallox.RegisterOutdoorTemp, RawValue: 100, Value: int16(5)},
+		{Source: 0x21, Destination: 0x11, Register: vallox.RegisterCurrentFanSpeed, RawValue: 1, Value: int16(1)},
+		{Source: 0x11, Destination: otherAddress, Register: vallox.RegisterRH1, RawValue: 60, Value: int16(40)},
+		{Source: 0x11, Destination: testAddress, Register: vallox.RegisterRH1, RawValue: 60, Value: int16(40)},
+		{Source: 0x11, Destination: testAddress, Register: vallox.RegisterCurrentFanSpeed, RawValue: 7, Value: int16(3)},
+	}
+	for _, e := range frames {
+		g.handleValloxEvent(e)
+	}
+	g.device.SetSpeed(3)
+
+	if speeds := bus.sentSpeeds(); len(speeds) != 3 {
+		t.Errorf("expected speeds to be sent to the bus, got %v", speeds)
+	}
+
+	now := time.Now().Add(busQueryTimeout + time.Second)
+	g.busStats.publish(g.mqtt, now)
+	expected := map[string]string{
+		topicBusFramesPerMinute: "5",
+		topicBusQueryTimeouts:   "1",
+		topicBusWriteRetries:    "1",
+		topicBusMainboardAge:    "6",
+	}
+	for topic, value := range expected {
+		if payloads := mqtt.waitFor(t, topic, 1); payloads[0] != value {
+			t.Errorf("expected %s to be %s, got %s", topic, value, payloads[0])
+		}
+	}
+
+	// frames are counted per interval, timed out query is counted once
+	g.busStats.publish(g.mqtt, now.Add(busStatsInterval))
+	expected = map[string]string{
+		topicBusFramesPerMinute: "0",
+		topicBusQueryTimeouts:   "1",
+		topicBusWriteRetries:    "1",
+		topicBusMainboardAge:    "66",
+	}
+	for topic, value := range expected {
+		if payloads := mqtt.waitFor(t, topic, 2); payloads[1] != value {
+			t.Errorf("expected %s to be %s next interval, got %s", topic, value, payloads[1])
+		}
+	}
+}
+
+func TestBusStatsWithoutMainboard(t *testing.T) {
+	g, _, mqtt := newTestGateway()
+
+	g.handleValloxEvent(vallox.Event{Source: 0x21, Destination: testAddress, Register: vallox.RegisterOutdoorTemp, RawValue: 100, Value: int16(5)})
+	g.busStats.publish(g.mqtt, time.Now())
+
+	if payloads := mqtt.waitFor(t, topicBusFramesPerMinute, 1); payloads[0] != "1" {
+		t.Errorf("expected 1 frame per minute, got %s", payloads[0])
+	}
+	time.Sleep(50 * time.Millisecond)
+	if payloads := mqtt.payloads(topicBusMainboardAge); len(payloads) != 0 {
+		t.Errorf("expected no mainboard frame age before a mainboard frame, got %v", payloads)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+// Bus capture writes every frame seen on the bus to CAPTURE_FILE, one frame per line:
+//
+//	<time RFC 3339 with nanoseconds> <source> <destination> <register> <raw value> <for me> <value>
+//
+// Addresses, register and raw value are two digit hex, for me is 1 when the frame was
+// addressed to this gateway and 0 otherwise, value is the decoded value as decimal,
+// true or false, or - when it is not a number.  Lines starting with # are comments.  Captures can be replayed with REPLAY_FILE.
+// File is rotated to CAPTURE_FILE.1 ... CAPTURE_FILE.<max files> when it reaches maximum size.
+// Frames are written by separate goroutine and dropped if it can not keep up, so
+// capturing never delays the gateway.
+
+const captureTimeLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// busCapture queues frames of one gateway to be written by run
+type busCapture struct {
+	file     string
+	maxSize  int64
+	maxFiles int
+	frames   chan string
+}
+
+// newCapture creates capture to CAPTURE_FILE
+func newCapture(c Config) *busCapture {
+	logInfo.Printf("capturing bus traffic to %s", c.CaptureFile)
+
+	return &busCapture{
+		file:     c.CaptureFile,
+		maxSize:  c.CaptureMaxSize,
+		maxFiles: c.CaptureMaxFiles,
+		frames:   make(chan string, 1000),
+	}
+}
+
+// event queues the frame to be written to capture file
+func (c *busCapture) event(e vallox.Event, forMe bool, t time.Time) {
+	select {
+	case c.frames <- formatCapture(e, forMe, t):
+	default:
+		logDebug.Printf("capture queue full, dropping frame")
+	}
+}
+
+func formatCapture(e vallox.Event, forMe bool, t time.Time) string {
+	me := 0
+	if forMe {
+		me = 1
+	}
+	return fmt.Sprintf("%s %02x %02x %02x %02x %d %s\n", t.Format(captureTimeLayout), e.Source, e.Destination, e.Register, e.RawValue, me, formatCaptureValue(e.Value))
+}
+
+// formatCaptureValue formats decoded value so that parseCaptureValue returns it
+func formatCaptureValue(value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		return strconv.FormatBool(v)
+	case float32, float64:
+		number, _ := numericValue(v)
+		return strconv.FormatFloat(number, 'g', -1, 64)
+	}
+	if number, ok := numericValue(value); ok {
+		return strconv.FormatInt(int64(number), 10)
+	}
+	return "-"
+}
+
+// run writes queued frames to capture file
+func (c *busCapture) run() {
+	var f *os.File
+	var w *bufio.Writer
+	var size int64
+
+	open := func() {
+		var err error
+		f, err = os.OpenFile(c.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			logError.Printf("cannot open capture file: %v", err)
+			f = nil
+			return
+		}
+		size = 0
+		if info, err := f.Stat(); err == nil {
+			size = info.Size()
+		}
+		w = bufio.NewWriter(f)
+		if size == 0 {
+			n, _ := w.WriteString("# time source destination register raw forme value\n")
+			size += int64(n)
+		}
+	}
+	open()
+
+	flush := time.NewTicker(time.Second)
+	for {
+		select {
+		case line := <-c.frames:
+			if f == nil {
+				open()
+				if f == nil {
+					continue
+				}
+			}
+			n, err := w.WriteString(line)
+			if err != nil {
+				logError.Printf("cannot write capture: %v", err)
+			}
+			size += int64(n)
+			if size >= c.maxSize {
+				w.Flush()
+				f.Close()
+				c.rotate()
+				open()
+			}
+		case <-flush.C:
+			if w != nil {
+				w.Flush()
+			}
+		}
+	}
+}
+
+// rotate shifts rotated files by one and moves current file to CAPTURE_FILE.1,
+// removing the oldest
+func (c *busCapture) rotate() {
+	name := func(i int) string {
+		if i == 0 {
+			return c.file
+		}
+		return fmt.Sprintf("%s.%d", c.file, i)
+	}
+
+	os.Remove(name(c.maxFiles))
+	for i := c.maxFiles - 1; i >= 0; i-- {
+		if err := os.Rename(name(i), name(i+1)); err != nil && !os.IsNotExist(err) {
+			logError.Printf("cannot rotate capture %s: %v", name(i), err)
+		}
+	}
+}
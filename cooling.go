@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	mqttClient "github.com/eclipse/paho.mqtt.golang"
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+// Summer night cooling raises fan speed during the night when inside is warmer than
+// the target and outside is cooler than inside by at least minimum spread.  Target is
+// never below the bypass operating temperature, as below it the cell is not bypassed
+// and heat recovery would warm the supply air.  Cooling ends when inside has cooled,
+// spread closes or the night ends.
+
+const (
+	topicCoolingActive     = "vallox/nightCooling/active"
+	topicCoolingEnabled    = "vallox/nightCooling/enabled"
+	topicCoolingEnabledSet = "vallox/nightCooling/enabled/set"
+	topicCoolingTarget     = "vallox/nightCooling/target"
+	topicCoolingTargetSet  = "vallox/nightCooling/target/set"
+
+	// temperature difference in °C required before cooling ends
+	coolingHysteresis = 1.0
+)
+
+// coolingSettings can be changed at runtime, kept in persistent state
+type coolingSettings struct {
+	Enabled bool    `json:"enabled"`
+	Target  float64 `json:"target"`
+}
+
+type coolingChange struct {
+	topic string
+	value string
+}
+
+// coolingController runs summer night cooling
+type coolingController struct {
+	enabled bool
+	start   time.Time
+	end     time.Time
+	spread  float64
+	speed   byte
+	state   *persistentState
+	active  bool
+
+	changes chan coolingChange
+}
+
+// newCooling creates night cooling from config, settings are kept in state
+func newCooling(c Config, state *persistentState, discovery map[string][]haEntity) *coolingController {
+	n := &coolingController{
+		enabled: c.NightCooling,
+		spread:  c.NightCoolingSpread,
+		speed:   c.NightCoolingSpeed,
+		state:   state,
+		changes: make(chan coolingChange, 10),
+	}
+	if !n.enabled {
+		return n
+	}
+
+	var err error
+	if n.start, err = time.Parse("15:04", c.NightCoolingStart); err != nil {
+		logError.Fatalf("invalid night cooling start %s", c.NightCoolingStart)
+	}
+	if n.end, err = time.Parse("15:04", c.NightCoolingEnd); err != nil {
+		logError.Fatalf("invalid night cooling end %s", c.NightCoolingEnd)
+	}
+
+	if state.Cooling == nil {
+		state.Cooling = &coolingSettings{Enabled: true, Target: c.NightCoolingTarget}
+	}
+
+	logInfo.Printf("night cooling between %s and %s", c.NightCoolingStart, c.NightCoolingEnd)
+
+	discovery["binary_sensor"] = append(discovery["binary_sensor"],
+		haEntity{
+			UniqueId:    "vallox_night_cooling_active",
+			Name:        "Yöjäähdytys käynnissä",
+			Device:      device,
+			DeviceClass: "cold",
+			StateTopic:  topicCoolingActive,
+			PayloadOn:   "true",
+			PayloadOff:  "false",
+		},
+	)
+	discovery["switch"] = append(discovery["switch"],
+		haEntity{
+			UniqueId:     "vallox_night_cooling_enabled",
+			Name:         "Yöjäähdytys",
+			Device:       device,
+			Icon:         "mdi:snowflake-thermometer",
+			StateTopic:   topicCoolingEnabled,
+			CommandTopic: topicCoolingEnabledSet,
+			PayloadOn:    "true",
+			PayloadOff:   "false",
+		},
+	)
+	discovery["number"] = append(discovery["number"],
+		haEntity{
+			UniqueId:          "vallox_night_cooling_target",
+			Name:              "Yöjäähdytyksen tavoitelämpötila",
+			Device:            device,
+			DeviceClass:       "temperature",
+			StateTopic:        topicCoolingTarget,
+			CommandTopic:      topicCoolingTargetSet,
+			UnitOfMeasurement: "°C",
+			haRange:           &haRange{Min: 15, Max: 30, Step: 0.5},
+		},
+	)
+	return n
+}
+
+// night returns true when now is within night cooling time, window may span midnight
+func (n *coolingController) night(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	start := n.start.Hour()*60 + n.start.Minute()
+	end := n.end.Hour()*60 + n.end.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// update starts or ends night cooling
+func (n *coolingController) update(mqtt publisher, cache map[byte]cacheEntry, now time.Time) {
+	if !n.enabled {
+		return
+	}
+	settings := n.state.Cooling
+
+	go publish(mqtt, topicCoolingEnabled, fmt.Sprint(settings.Enabled))
+	go publish(mqtt, topicCoolingTarget, fmt.Sprint(settings.Target))
+
+	inside, okInside := cachedNumber(cache, vallox.RegisterExhaustInTemp)
+	outdoor, okOutdoor := cachedNumber(cache, vallox.RegisterOutdoorTemp)
+
+	target := settings.Target
+	if bypass, ok := cachedNumber(cache, vallox.RegisterBypassTemp); ok && bypass > target {
+		target = bypass
+	}
+
+	night := n.night(now)
+	if !n.active && settings.Enabled && night && okInside && okOutdoor &&
+		inside > target && inside-outdoor >= n.spread {
+		logInfo.Printf("night cooling started, inside %.0f°C outdoor %.0f°C", inside, outdoor)
+		n.active = true
+	} else if n.active && (!settings.Enabled || !night || !okInside || !okOutdoor ||
+		inside <= target-coolingHysteresis || inside-outdoor < n.spread-coolingHysteresis) {
+		logInfo.Printf("night cooling ended, inside %.0f°C outdoor %.0f°C", inside, outdoor)
+		n.active = false
+	}
+
+	go publish(mqtt, topicCoolingActive, fmt.Sprint(n.active))
+}
+
+// speedRequest requests night cooling speed while cooling is active
+func (n *coolingController) speedRequest() speedRequest {
+	request := speedRequest{source: speedSourceCooling}
+	if n.active {
+		request.speed = n.speed
+	}
+	return request
+}
+
+// change changes night cooling settings
+func (n *coolingController) change(change coolingChange) {
+	switch change.topic {
+	case topicCoolingEnabledSet:
+		enabled, err := strconv.ParseBool(change.value)
+		if err != nil {
+			logError.Printf("cannot parse night cooling enabled from body %s", change.value)
+			return
+		}
+		n.state.Cooling.Enabled = enabled
+	case topicCoolingTargetSet:
+		target, err := strconv.ParseFloat(change.value, 64)
+		if err != nil {
+			logError.Printf("cannot parse night cooling target from body %s", change.value)
+			return
+		}
+		n.state.Cooling.Target = target
+	}
+	n.state.dirty = true
+}
+
+func (n *coolingController) subscribe(mqtt mqttClient.Client) {
+	for _, topic := range []string{topicCoolingEnabledSet, topicCoolingTargetSet} {
+		mqtt.Subscribe(topic, 0, n.message)
+	}
+}
+
+func (n *coolingController) message(mqtt mqttClient.Client, msg mqttClient.Message) {
+	n.changes <- coolingChange{topic: msg.Topic(), value: string(msg.Payload())}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+func newTestCooling() *coolingController {
+	return newCooling(Config{
+		NightCooling:       true,
+		NightCoolingStart:  "22:00",
+		NightCoolingEnd:    "06:00",
+		NightCoolingSpread: 3,
+		NightCoolingTarget: 21,
+		NightCoolingSpeed:  6,
+	}, newPersistentState(), make(map[string][]haEntity))
+}
+
+func TestCoolingNight(t *testing.T) {
+	n := newTestCooling()
+	tests := []struct {
+		time  string
+		night bool
+	}{
+		{"21:59", false},
+		{"22:00", true},
+		{"23:59", true},
+		{"00:00", true},
+		{"05:59", true},
+		{"06:00", false},
+		{"12:00", false},
+	}
+	for _, test := range tests {
+		now, _ := time.Parse("15:04", test.time)
+		if night := n.night(now); night != test.night {
+			t.Errorf("%s: expected night %v, got %v", test.time, test.night, night)
+		}
+	}
+}
+
+func TestCoolingUpdate(t *testing.T) {
+	night := time.Date(2024, 7, 12, 23, 0, 0, 0, time.Local)
+	day := time.Date(2024, 7, 12, 12, 0, 0, 0, time.Local)
+
+	// each step continues from the state of the previous one
+	steps := []struct {
+		name    string
+		now     time.Time
+		inside  int16
+		outdoor int16
+		bypass  int16
+		change  *coolingChange
+		active  bool
+	}{
+		{"day", day, 25, 15, 0, nil, false},
+		{"outside not cool enough", night, 25, 23, 0, nil, false},
+		{"inside at target", night, 21, 15, 0, nil, false},
+		{"inside below bypass temperature", night, 22, 15, 23, nil, false},
+		{"starts", night, 25, 15, 0, nil, true},
+		{"hysteresis of target", night, 21, 15, 0, nil, true},
+		{"hysteresis of spread", night, 21, 19, 0, nil, true},
+		{"spread closes", night, 21, 20, 0, nil, false},
+		{"starts again", night, 25, 15, 0, nil, true},
+		{"inside cooled", night, 20, 15, 0, nil, false},
+		{"starts again", night, 25, 15, 0, nil, true},
+		{"disabled", night, 25, 15, 0, &coolingChange{topicCoolingEnabledSet, "false"}, false},
+		{"enabled", night, 25, 15, 0, &coolingChange{topicCoolingEnabledSet, "true"}, true},
+		{"target raised", night, 25, 15, 0, &coolingChange{topicCoolingTargetSet, "26.5"}, false},
+		{"invalid target ignored", night, 25, 15, 0, &coolingChange{topicCoolingTargetSet, "warm"}, false},
+		{"target lowered", night, 25, 15, 0, &coolingChange{topicCoolingTargetSet, "22"}, true},
+		{"night ends", day.Add(-6 * time.Hour), 25, 15, 0, nil, false},
+	}
+
+	n := newTestCooling()
+	mqtt := &testPublisher{}
+	for _, step := range steps {
+		if step.change != nil {
+			n.change(*step.change)
+		}
+		values := map[byte]int16{vallox.RegisterExhaustInTemp: step.inside, vallox.RegisterOutdoorTemp: step.outdoor}
+		if step.bypass != 0 {
+			values[vallox.RegisterBypassTemp] = step.bypass
+		}
+		n.update(mqtt, testCache(values), step.now)
+		if n.active != step.active {
+			t.Errorf("%s: expected active %v, got %v", step.name, step.active, n.active)
+		}
+		if request := n.speedRequest(); (request.speed == 6) != step.active {
+			t.Errorf("%s: unexpected speed request %d", step.name, request.speed)
+		}
+	}
+	if n.state.Cooling.Target != 22 || !n.state.dirty {
+		t.Errorf("expected changed target 22 in state, got %v", n.state.Cooling.Target)
+	}
+}
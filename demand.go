@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mqttClient "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Demand controlled ventilation from external CO2 and humidity sensors.
+// Sensors are configured as "topic" for plain values or "topic|path.to.value" for json.
+// Levels map the highest reading to fan speed, for example "800:3,1000:4,1200:5".
+// Speed is raised immediately, lowered only after the reading is below the level
+// by hysteresis and the previous change is older than minimum hold time.  Speed is
+// requested while demand control is enabled and has recent readings.
+
+const (
+	topicDemandCO2        = "vallox/demand/co2"
+	topicDemandRH         = "vallox/demand/rh"
+	topicDemandSpeed      = "vallox/demand/speed"
+	topicDemandEnabled    = "vallox/demand/enabled"
+	topicDemandEnabledSet = "vallox/demand/enabled/set"
+
+	controlInterval = 30 * time.Second
+)
+
+type demandSensor struct {
+	topic string
+	path  string // dot separated json path, empty for plain values
+}
+
+type demandLevel struct {
+	threshold float64
+	speed     byte
+}
+
+type demandReading struct {
+	sensor demandSensor
+	value  float64
+	time   time.Time
+}
+
+// demandController requests speed from external sensor readings
+type demandController struct {
+	co2Sensors    []demandSensor
+	rhSensors     []demandSensor
+	co2Levels     []demandLevel
+	rhLevels      []demandLevel
+	co2Hysteresis float64
+	rhHysteresis  float64
+	minSpeed      byte
+	maxSpeed      byte
+	minHold       time.Duration
+	sensorTimeout time.Duration
+
+	readings map[demandSensor]demandReading
+	enabled  bool
+	speed    byte
+	changed  time.Time
+	co2Speed byte // speed of the co2 level reached, kept separate for hysteresis
+	rhSpeed  byte // speed of the humidity level reached
+
+	readingUpdates chan demandReading
+	enableRequests chan bool
+}
+
+// newDemand parses demand control configuration, demand control is disabled without sensors
+func newDemand(c Config, discovery map[string][]haEntity) *demandController {
+	d := &demandController{
+		co2Hysteresis:  c.DemandCO2Hysteresis,
+		rhHysteresis:   c.DemandRHHysteresis,
+		minSpeed:       c.DemandMinSpeed,
+		maxSpeed:       c.DemandMaxSpeed,
+		minHold:        c.DemandMinHold,
+		sensorTimeout:  c.DemandSensorTimeout,
+		readings:       make(map[demandSensor]demandReading),
+		enabled:        true,
+		readingUpdates: make(chan demandReading, 10),
+		enableRequests: make(chan bool, 10),
+	}
+
+	var err error
+	if d.co2Sensors, err = parseDemandSensors(c.DemandCO2Topics); err != nil {
+		logError.Fatalf("invalid demand co2 topics: %v", err)
+	}
+	if d.rhSensors, err = parseDemandSensors(c.DemandRHTopics); err != nil {
+		logError.Fatalf("invalid demand rh topics: %v", err)
+	}
+	if d.co2Levels, err = parseDemandLevels(c.DemandCO2Levels); err != nil {
+		logError.Fatalf("invalid demand co2 levels: %v", err)
+	}
+	if d.rhLevels, err = parseDemandLevels(c.DemandRHLevels); err != nil {
+		logError.Fatalf("invalid demand rh levels: %v", err)
+	}
+	if !d.configured() {
+		return d
+	}
+
+	logInfo.Printf("demand control with %d co2 and %d humidity sensors", len(d.co2Sensors), len(d.rhSensors))
+
+	discovery["sensor"] = append(discovery["sensor"],
+		haEntity{
+			UniqueId:          "vallox_demand_co2",
+			Name:              "Ohjauksen CO2",
+			Device:            device,
+			DeviceClass:       "carbon_dioxide",
+			StateClass:        "measurement",
+			StateTopic:        topicDemandCO2,
+			UnitOfMeasurement: "ppm",
+		},
+		haEntity{
+			UniqueId:          "vallox_demand_rh",
+			Name:              "Ohjauksen kosteus",
+			Device:            device,
+			DeviceClass:       "humidity",
+			StateClass:        "measurement",
+			StateTopic:        topicDemandRH,
+			UnitOfMeasurement: "%",
+		},
+		haEntity{
+			UniqueId:   "vallox_demand_speed",
+			Name:       "Tarpeenmukainen nopeus",
+			Device:     device,
+			Icon:       "mdi:fan-auto",
+			StateTopic: topicDemandSpeed,
+		},
+	)
+	discovery["switch"] = append(discovery["switch"],
+		haEntity{
+			UniqueId:     "vallox_demand_enabled",
+			Name:         "Tarpeenmukainen ilmanvaihto",
+			Device:       device,
+			Icon:         "mdi:fan-auto",
+			StateTopic:   topicDemandEnabled,
+			CommandTopic: topicDemandEnabledSet,
+			PayloadOn:    "true",
+			PayloadOff:   "false",
+		},
+	)
+	return d
+}
+
+func (d *demandController) configured() bool {
+	return len(d.co2Sensors) > 0 || len(d.rhSensors) > 0
+}
+
+func parseDemandSensors(entries []string) ([]demandSensor, error) {
+	var sensors []demandSensor
+	for _, entry := range entries {
+		parts := strings.SplitN(strings.TrimSpace(entry), "|", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("empty topic in %q", entry)
+		}
+		sensor := demandSensor{topic: parts[0]}
+		if len(parts) == 2 {
+			sensor.path = parts[1]
+		}
+		sensors = append(sensors, sensor)
+	}
+	return sensors, nil
+}
+
+func parseDemandLevels(entries []string) ([]demandLevel, error) {
+	var levels []demandLevel
+	for _, entry := range entries {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("level %q should be <threshold>:<speed>", entry)
+		}
+		threshold, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold in %q", entry)
+		}
+		speed, err := strconv.ParseUint(parts[1], 10, 8)
+		if err != nil || speed < 1 || speed > 8 {
+			return nil, fmt.Errorf("invalid speed in %q", entry)
+		}
+		levels = append(levels, demandLevel{threshold: threshold, speed: byte(speed)})
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i].threshold < levels[j].threshold })
+	return levels, nil
+}
+
+// update requests speed based on the highest recent readings
+func (d *demandController) update(mqtt publisher, now time.Time) {
+	if !d.configured() {
+		return
+	}
+
+	go publish(mqtt, topicDemandEnabled, fmt.Sprint(d.enabled))
+
+	co2, okCO2 := d.maxReading(d.co2Sensors, now)
+	rh, okRH := d.maxReading(d.rhSensors, now)
+	if okCO2 {
+		go publish(mqtt, topicDemandCO2, fmt.Sprintf("%.0f", co2))
+	}
+	if okRH {
+		go publish(mqtt, topicDemandRH, fmt.Sprintf("%.0f", rh))
+	}
+	if !okCO2 && !okRH {
+		d.speed = 0 // no recent readings
+		return
+	}
+
+	if okCO2 {
+		d.co2Speed = demandLevelSpeed(co2, d.co2Levels, d.co2Hysteresis, d.co2Speed)
+	} else {
+		d.co2Speed = 0
+	}
+	if okRH {
+		d.rhSpeed = demandLevelSpeed(rh, d.rhLevels, d.rhHysteresis, d.rhSpeed)
+	} else {
+		d.rhSpeed = 0
+	}
+	target := maxSpeed(d.minSpeed, maxSpeed(d.co2Speed, d.rhSpeed))
+	if target > d.maxSpeed {
+		target = d.maxSpeed
+	}
+
+	go publish(mqtt, topicDemandSpeed, fmt.Sprint(target))
+
+	if !d.enabled {
+		d.speed = 0
+		return
+	}
+	if target == d.speed {
+		return
+	}
+	if target < d.speed && now.Sub(d.changed) < d.minHold {
+		return // keep higher speed for minimum hold time
+	}
+
+	logInfo.Printf("demand control requesting speed %d (co2 %.0f, rh %.0f)", target, co2, rh)
+	d.speed = target
+	d.changed = now
+}
+
+// speedRequest requests speed of demand control while it has recent readings
+func (d *demandController) speedRequest() speedRequest {
+	return speedRequest{source: speedSourceDemand, speed: d.speed}
+}
+
+// demandLevelSpeed returns speed of the highest level reached, current level speed of
+// the same sensor kind is kept until the value is below its threshold by hysteresis
+func demandLevelSpeed(value float64, levels []demandLevel, hysteresis float64, current byte) byte {
+	speed := byte(0)
+	for _, level := range levels {
+		if value >= level.threshold || (value >= level.threshold-hysteresis && current >= level.speed) {
+			speed = maxSpeed(speed, level.speed)
+		}
+	}
+	return speed
+}
+
+func (d *demandController) maxReading(sensors []demandSensor, now time.Time) (float64, bool) {
+	max, found := 0.0, false
+	for _, sensor := range sensors {
+		reading, ok := d.readings[sensor]
+		if !ok || now.Sub(reading.time) > d.sensorTimeout {
+			continue
+		}
+		if !found || reading.value > max {
+			max, found = reading.value, true
+		}
+	}
+	return max, found
+}
+
+func maxSpeed(a byte, b byte) byte {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (d *demandController) subscribe(mqtt mqttClient.Client) {
+	mqtt.Subscribe(topicDemandEnabledSet, 0, d.enabledMessage)
+}
+
+// sensorRoutes delivers demand sensor readings to demand control
+func (d *demandController) sensorRoutes() []sensorRoute {
+	var routes []sensorRoute
+	for _, sensor := range append(append([]demandSensor{}, d.co2Sensors...), d.rhSensors...) {
+		routes = append(routes, sensorRoute{sensor: sensor, readings: d.readingUpdates})
+	}
+	return routes
+}
+
+// sensorRoute delivers readings of a sensor to the controller using it
+type sensorRoute struct {
+	sensor   demandSensor
+	readings chan<- demandReading
+}
+
+// subscribeSensors subscribes each sensor topic once and parses every message for all
+// sensors of the topic, as mqtt client replaces the handler when a topic is subscribed again
+func subscribeSensors(mqtt mqttClient.Client, routes []sensorRoute) {
+	var topics []string
+	byTopic := make(map[string][]sensorRoute)
+	for _, route := range routes {
+		if _, ok := byTopic[route.sensor.topic]; !ok {
+			topics = append(topics, route.sensor.topic)
+		}
+		byTopic[route.sensor.topic] = append(byTopic[route.sensor.topic], route)
+	}
+
+	for _, topic := range topics {
+		routes := byTopic[topic]
+		mqtt.Subscribe(topic, 0, func(mqtt mqttClient.Client, msg mqttClient.Message) {
+			now := time.Now()
+			for _, route := range routes {
+				value, err := parseDemandValue(msg.Payload(), route.sensor.path)
+				if err != nil {
+					logError.Printf("cannot parse sensor value from %s: %v", msg.Topic(), err)
+					continue
+				}
+				route.readings <- demandReading{sensor: route.sensor, value: value, time: now}
+			}
+		})
+	}
+}
+
+// parseDemandValue parses plain number or number from json path
+func parseDemandValue(payload []byte, path string) (float64, error) {
+	if path == "" {
+		return strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return 0, err
+	}
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return 0, fmt.Errorf("no %s in json", path)
+		}
+		value = object[key]
+	}
+
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	default:
+		return 0, fmt.Errorf("no number at %s", path)
+	}
+}
+
+func (d *demandController) enabledMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
+	body := string(msg.Payload())
+	enabled, err := strconv.ParseBool(body)
+	if err != nil {
+		logError.Printf("cannot parse demand control enabled from body %s", body)
+		return
+	}
+	d.enableRequests <- enabled
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscribeSensorsSharedTopic(t *testing.T) {
+	broker := startTestBroker(t)
+	defer broker.close()
+
+	client := connectTestClient(t, broker, "sensors")
+	defer client.Disconnect(0)
+
+	co2 := demandSensor{topic: "zigbee/room", path: "co2"}
+	rh := demandSensor{topic: "zigbee/room", path: "humidity"}
+	co2Readings := make(chan demandReading, 1)
+	rhReadings := make(chan demandReading, 1)
+	subscribeSensors(client, []sensorRoute{
+		{sensor: co2, readings: co2Readings},
+		{sensor: rh, readings: rhReadings},
+	})
+	broker.waitSubscribed(t, "zigbee/room")
+
+	client.Publish("zigbee/room", 0, false, `{"co2": 900, "humidity": 55}`)
+
+	for _, want := range []struct {
+		readings chan demandReading
+		sensor   demandSensor
+		value    float64
+	}{
+		{co2Readings, co2, 900},
+		{rhReadings, rh, 55},
+	} {
+		select {
+		case reading := <-want.readings:
+			if reading.sensor != want.sensor || reading.value != want.value {
+				t.Errorf("expected %v from %v, got %v from %v", want.value, want.sensor, reading.value, reading.sensor)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("no reading for %v", want.sensor)
+		}
+	}
+}
+
+// TestSensorRoutesSpikeAndDemand checks that spike detection and demand control both get
+// readings of a bathroom sensor used by both
+func TestSensorRoutesSpikeAndDemand(t *testing.T) {
+	g, _, _ := newTestGateway()
+	sensor := demandSensor{topic: "zigbee/bathroom", path: "humidity"}
+	g.demand.rhSensors = []demandSensor{sensor}
+	g.spike.sensor = &sensor
+
+	broker := startTestBroker(t)
+	defer broker.close()
+	client := connectTestClient(t, broker, "sensors")
+	defer client.Disconnect(0)
+
+	subscribeSensors(client, append(g.demand.sensorRoutes(), g.spike.sensorRoutes()...))
+	broker.waitSubscribed(t, sensor.topic)
+	client.Publish(sensor.topic, 0, false, `{"humidity": 80}`)
+
+	for name, readings := range map[string]chan demandReading{"demand": g.demand.readingUpdates, "spike": g.spike.readings} {
+		select {
+		case reading := <-readings:
+			if reading.value != 80 {
+				t.Errorf("expected %s humidity 80, got %v", name, reading.value)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("no %s reading", name)
+		}
+	}
+}
+
+// TestDemandHysteresisPerKind checks that speed reached by co2 does not latch humidity level
+func TestDemandHysteresisPerKind(t *testing.T) {
+	co2 := demandSensor{topic: "sensors/co2"}
+	rh := demandSensor{topic: "sensors/rh"}
+	d := &demandController{
+		co2Sensors:    []demandSensor{co2},
+		rhSensors:     []demandSensor{rh},
+		co2Levels:     []demandLevel{{threshold: 1000, speed: 4}},
+		rhLevels:      []demandLevel{{threshold: 60, speed: 4}},
+		co2Hysteresis: 50,
+		rhHysteresis:  3,
+		minSpeed:      2,
+		maxSpeed:      6,
+		sensorTimeout: time.Hour,
+		readings:      make(map[demandSensor]demandReading),
+		enabled:       true,
+	}
+
+	now := time.Now()
+	tests := []struct {
+		co2, rh  float64
+		expected byte
+	}{
+		{co2: 1100, rh: 58, expected: 4}, // co2 level reached, humidity within its hysteresis
+		{co2: 900, rh: 58, expected: 2},  // co2 below hysteresis, humidity never reached its level
+		{co2: 900, rh: 61, expected: 4},
+		{co2: 900, rh: 58, expected: 4}, // humidity level kept by its own hysteresis
+		{co2: 900, rh: 56, expected: 2},
+	}
+	for i, test := range tests {
+		now = now.Add(time.Hour) // past minimum hold
+		d.readings[co2] = demandReading{sensor: co2, value: test.co2, time: now}
+		d.readings[rh] = demandReading{sensor: rh, value: test.rh, time: now}
+		d.update(&testPublisher{}, now)
+		if d.speed != test.expected {
+			t.Errorf("step %d co2 %v rh %v: expected speed %d, got %d", i, test.co2, test.rh, test.expected, d.speed)
+		}
+	}
+}
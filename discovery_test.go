@@ -0,0 +1,229 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	mqttClient "github.com/eclipse/paho.mqtt.golang"
+	vallox "github.com/jokujossai/vallox-rs485"
+	"github.com/kelseyhightower/envconfig"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+const discoveryGolden = "discovery.golden"
+
+// withAllFeatures runs f with a gateway having every optional feature enabled, so
+// its discovery contains all entities
+func withAllFeatures(t *testing.T, mqttUrl string, f func(g *Gateway)) {
+	for key, value := range map[string]string{
+		"SERIAL_DEVICE":     "/dev/null",
+		"MQTT_URL":          mqttUrl,
+		"AIRFLOW":           "20,30,40,50,60,70,80,90",
+		"POST_HEATER_POWER": "1000",
+		"FAN_POWER":         "10,15,20,30,40,55,70,90",
+		"SCHEDULE":          "mon-fri 07:00 4",
+		"DEMAND_CO2_TOPICS": "sensors/co2",
+		"DEMAND_RH_TOPICS":  "sensors/rh",
+		"SPIKE_DETECTION":   "true",
+		"NIGHT_COOLING":     "true",
+		"FROST_PROTECTION":  "true",
+	} {
+		t.Setenv(key, value)
+	}
+	var c Config
+	if err := envconfig.Process("vallox", &c); err != nil {
+		t.Fatal(err)
+	}
+
+	f(newGateway(c, newPersistentState(), &testBus{events: make(chan vallox.Event)}))
+}
+
+func TestDiscoveryGolden(t *testing.T) {
+	withAllFeatures(t, "tcp://localhost:1883", func(g *Gateway) {
+		mqtt := &testPublisher{}
+		g.mqtt = mqtt
+		g.announceDiscovery()
+
+		var lines []string
+		for _, msg := range mqtt.messages {
+			lines = append(lines, msg.topic+" "+msg.payload)
+		}
+		sort.Strings(lines)
+		got := strings.Join(lines, "\n") + "\n"
+
+		golden := filepath.Join("testdata", discoveryGolden)
+		if *update {
+			if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("cannot read golden file, run go test -update: %v", err)
+		}
+
+		wantLines := strings.Split(strings.TrimSuffix(string(want), "\n"), "\n")
+		if got != string(want) {
+			for i := 0; i < len(lines) || i < len(wantLines); i++ {
+				var g, w string
+				if i < len(lines) {
+					g = lines[i]
+				}
+				if i < len(wantLines) {
+					w = wantLines[i]
+				}
+				if g != w {
+					t.Errorf("discovery differs from %s, run go test -update if intended\ngot:  %s\nwant: %s", golden, g, w)
+					break
+				}
+			}
+		}
+	})
+}
+
+// TestDiscoveryTopics checks that state topics of all entities are published when the
+// gateway receives every register and runs its periodic updates, and that command topics
+// of all entities are subscribed
+func TestDiscoveryTopics(t *testing.T) {
+	broker := startTestBroker(t)
+	defer broker.close()
+
+	withAllFeatures(t, broker.url, func(g *Gateway) {
+		mqtt := &testPublisher{}
+		g.mqtt = mqtt
+
+		values := map[byte]int16{
+			vallox.RegisterOutdoorTemp:    5,
+			vallox.RegisterExhaustInTemp:  22,
+			vallox.RegisterExhaustOutTemp: 8,
+			vallox.RegisterSupplyTemp:     18,
+			vallox.RegisterIO08:           0, // heat exchanger not bypassed
+		}
+		received := make(map[byte]bool)
+		for _, e := range registry {
+			for _, register := range []byte{e.register, e.low} {
+				if register == 0 || received[register] {
+					continue
+				}
+				received[register] = true
+				value, ok := values[register]
+				if !ok {
+					value = 3
+				}
+				g.handleValloxEvent(vallox.Event{Source: 0x11, Destination: testAddress, Register: register, RawValue: byte(value), Value: value})
+			}
+		}
+		// counter reset is recorded as the last service date
+		g.handleValloxEvent(vallox.Event{Source: 0x11, Destination: testAddress, Register: vallox.RegisterServiceCounter, RawValue: 0, Value: int16(0)})
+
+		now := time.Now()
+		for _, sensor := range append(g.demand.co2Sensors, g.demand.rhSensors...) {
+			g.demand.readings[sensor] = demandReading{sensor: sensor, value: 50, time: now}
+		}
+		g.busStats.recordFrame(vallox.Event{Source: 0x11, Destination: 0x21}, false, now)
+
+		// periodic updates of the run loop
+		publishFaults(mqtt, g.state)
+		g.updateEnergy(now)
+		g.updateEnergy(now.Add(time.Minute))
+		publishService(mqtt, g.state, g.cache, now)
+		g.schedule.update(mqtt, now)
+		g.boost.update(mqtt, now)
+		g.demand.update(mqtt, now)
+		g.spike.update(mqtt, g.cache, now)
+		g.cooling.update(mqtt, g.cache, now)
+		g.frost.update(mqtt, g.cache, now.Add(-frostTrendWindow))
+		g.frost.update(mqtt, g.cache, now)
+		g.busStats.publish(mqtt, now)
+
+		for component, entries := range g.discovery {
+			for _, entry := range entries {
+				for _, topic := range []string{entry.StateTopic, entry.AvailabilityTopic} {
+					if topic != "" && !waitPublished(mqtt, topic) {
+						t.Errorf("%s %s topic %s is not published", component, entry.UniqueId, topic)
+					}
+				}
+			}
+		}
+
+		client := mqttClient.NewClient(mqttClient.NewClientOptions().AddBroker(broker.url).SetClientID("discovery-test"))
+		if token := client.Connect(); token.Wait() && token.Error() != nil {
+			t.Fatalf("cannot connect: %v", token.Error())
+		}
+		defer client.Disconnect(0)
+		g.subscribe(client)
+
+		for _, entries := range g.discovery {
+			for _, entry := range entries {
+				if entry.CommandTopic != "" {
+					broker.waitSubscribed(t, entry.CommandTopic)
+				}
+			}
+		}
+	})
+}
+
+// waitPublished waits a moment for a message to topic, values are published asynchronously
+func waitPublished(mqtt *testPublisher, topic string) bool {
+	deadline := time.Now().Add(time.Second)
+	for len(mqtt.payloads(topic)) == 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
+// TestRegistry checks that registry entities have unique topics and a single decoding
+func TestRegistry(t *testing.T) {
+	topics := make(map[string]bool)
+	for _, e := range registry {
+		if topics[e.topic] {
+			t.Errorf("duplicate registry topic %s", e.topic)
+		}
+		topics[e.topic] = true
+		if e.flag != 0 && e.isWord() {
+			t.Errorf("%s has both flag and low byte register", e.topic)
+		}
+		if e.set != nil && e.component == "" {
+			t.Errorf("writable %s is not announced", e.topic)
+		}
+	}
+}
+
+func TestGatewaysDoNotShareState(t *testing.T) {
+	withAllFeatures(t, "tcp://localhost:1883", func(first *Gateway) {
+		withAllFeatures(t, "tcp://localhost:1883", func(second *Gateway) {
+			first.state.Spike.Rise = 99
+			first.discovery["sensor"] = nil
+			first.frost.active = true
+			first.busStats.recordFrame(vallox.Event{Source: 0x11, Destination: 0x21}, false, time.Now())
+			first.notifier.sent["bus_silent"] = time.Now()
+			first.notifier.status = vallox.StatusFlagFilter
+			first.efficiencyAvailable = "online"
+
+			if second.state.Spike.Rise == 99 || len(second.discovery["sensor"]) == 0 || second.frost.active {
+				t.Errorf("expected gateways to have their own state, discovery and controllers")
+			}
+			if second.busStats.frames != 0 || !second.busStats.mainboardFrame.IsZero() {
+				t.Errorf("expected gateways to have their own bus statistics")
+			}
+			if len(second.notifier.sent) != 0 || second.notifier.status != 0 {
+				t.Errorf("expected gateways to have their own notification state")
+			}
+			if second.efficiencyAvailable != "" {
+				t.Errorf("expected gateways to have their own efficiency availability")
+			}
+			if len(baseDiscovery["sensor"]) == 0 {
+				t.Errorf("expected base discovery not to change")
+			}
+		})
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+// Temperature efficiency of the heat exchanger calculated from the four air temperatures.
+// Efficiency is not meaningful when the cell is bypassed (summer mode) or when
+// the difference between inside and outside temperature is small.
+
+const (
+	topicEfficiencySupply    = "vallox/efficiency/supply"
+	topicEfficiencyExhaust   = "vallox/efficiency/exhaust"
+	topicEfficiencyAvailable = "vallox/efficiency/available"
+)
+
+// registers the efficiency is calculated from
+var efficiencyRegisters = map[byte]bool{
+	vallox.RegisterOutdoorTemp:    true,
+	vallox.RegisterSupplyTemp:     true,
+	vallox.RegisterExhaustInTemp:  true,
+	vallox.RegisterExhaustOutTemp: true,
+	vallox.RegisterIO08:           true,
+}
+
+// publishEfficiency publishes supply and exhaust side efficiency when any of the source values change
+func (g *Gateway) publishEfficiency(register byte) {
+	if !efficiencyRegisters[register] {
+		return
+	}
+
+	mqtt := g.mqtt
+	supply, exhaust, ok := efficiency(g.cache, g.efficiencyMinSpread)
+
+	available := "offline"
+	if ok {
+		available = "online"
+		go publish(mqtt, topicEfficiencySupply, fmt.Sprintf("%.1f", supply))
+		go publish(mqtt, topicEfficiencyExhaust, fmt.Sprintf("%.1f", exhaust))
+	}
+	if available != g.efficiencyAvailable {
+		g.efficiencyAvailable = available
+		go publish(mqtt, topicEfficiencyAvailable, available)
+	}
+}
+
+// efficiency returns supply and exhaust side temperature efficiency in percent,
+// not available when inside and outside differ less than minSpread
+func efficiency(cache map[byte]cacheEntry, minSpread float64) (float64, float64, bool) {
+	if io8, ok := cache[vallox.RegisterIO08]; ok && io8.value.RawValue&vallox.IO08FlagSummerMode == vallox.IO08FlagSummerMode {
+		return 0, 0, false // heat exchanger is bypassed
+	}
+
+	temps := make(map[byte]float64)
+	for _, register := range []byte{vallox.RegisterOutdoorTemp, vallox.RegisterSupplyTemp, vallox.RegisterExhaustInTemp, vallox.RegisterExhaustOutTemp} {
+		cached, ok := cache[register]
+		if !ok {
+			return 0, 0, false
+		}
+		temp, ok := numericValue(cached.value.Value)
+		if !ok {
+			return 0, 0, false
+		}
+		temps[register] = temp
+	}
+
+	outdoor := temps[vallox.RegisterOutdoorTemp]
+	exhaustIn := temps[vallox.RegisterExhaustInTemp]
+	spread := exhaustIn - outdoor
+	if math.Abs(spread) < minSpread {
+		return 0, 0, false
+	}
+
+	supply := (temps[vallox.RegisterSupplyTemp] - outdoor) / spread * 100
+	exhaust := (exhaustIn - temps[vallox.RegisterExhaustOutTemp]) / spread * 100
+	return supply, exhaust, true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+func efficiencyTemps(outdoor, supply, exhaustIn, exhaustOut int16) map[byte]int16 {
+	return map[byte]int16{
+		vallox.RegisterOutdoorTemp:    outdoor,
+		vallox.RegisterSupplyTemp:     supply,
+		vallox.RegisterExhaustInTemp:  exhaustIn,
+		vallox.RegisterExhaustOutTemp: exhaustOut,
+	}
+}
+
+func TestEfficiency(t *testing.T) {
+	summer := efficiencyTemps(0, 4, 5, 1)
+	summer[vallox.RegisterIO08] = int16(vallox.IO08FlagSummerMode)
+	missing := efficiencyTemps(0, 4, 5, 1)
+	delete(missing, vallox.RegisterExhaustOutTemp)
+
+	tests := []struct {
+		name      string
+		values    map[byte]int16
+		supply    float64
+		exhaust   float64
+		available bool
+	}{
+		{"spread at threshold", efficiencyTemps(0, 4, 5, 1), 80, 80, true},
+		{"spread below threshold", efficiencyTemps(0, 3, 4, 1), 0, 0, false},
+		{"winter", efficiencyTemps(-10, 15, 20, -4), 25.0 / 30 * 100, 24.0 / 30 * 100, true},
+		{"outside warmer at threshold", efficiencyTemps(25, 21, 20, 24), 80, 80, true},
+		{"outside warmer below threshold", efficiencyTemps(24, 21, 20, 23), 0, 0, false},
+		{"heat exchanger bypassed", summer, 0, 0, false},
+		{"temperature missing", missing, 0, 0, false},
+	}
+	for _, test := range tests {
+		supply, exhaust, ok := efficiency(testCache(test.values), 5)
+		if ok != test.available || math.Abs(supply-test.supply) > 1e-9 || math.Abs(exhaust-test.exhaust) > 1e-9 {
+			t.Errorf("%s: expected %.1f %.1f %v, got %.1f %.1f %v", test.name, test.supply, test.exhaust, test.available, supply, exhaust, ok)
+		}
+	}
+}
+
+func TestPublishEfficiencyAvailable(t *testing.T) {
+	g, _, mqtt := newTestGateway()
+	g.efficiencyMinSpread = 5
+
+	steps := []struct {
+		temps     map[byte]int16
+		available []string
+	}{
+		{efficiencyTemps(0, 4, 5, 1), []string{"online"}},
+		{efficiencyTemps(0, 4, 5, 2), []string{"online"}}, // unchanged availability is not republished
+		{efficiencyTemps(1, 4, 5, 2), []string{"online", "offline"}},
+		{efficiencyTemps(0, 4, 5, 2), []string{"online", "offline", "online"}},
+	}
+	for i, step := range steps {
+		for register, value := range testCache(step.temps) {
+			g.cache[register] = value
+		}
+		g.publishEfficiency(vallox.RegisterOutdoorTemp)
+		if available := mqtt.waitFor(t, topicEfficiencyAvailable, len(step.available)); len(available) != len(step.available) || available[len(available)-1] != step.available[len(step.available)-1] {
+			t.Errorf("step %d: expected availability %v, got %v", i, step.available, available)
+		}
+	}
+
+	g.publishEfficiency(vallox.RegisterRH1)
+	time.Sleep(50 * time.Millisecond)
+	if available := mqtt.payloads(topicEfficiencyAvailable); len(available) != 3 {
+		t.Errorf("expected other registers not to update efficiency, got %v", available)
+	}
+}
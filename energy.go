@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+// Estimated power is integrated to accumulated energy on every energyInterval.
+// Energy is not accumulated while the bus is silent, as the power is then unknown.
+
+const (
+	topicRecoveredPower   = "vallox/energy/recovered/power"
+	topicRecoveredEnergy  = "vallox/energy/recovered/total"
+	topicPostHeatingPower = "vallox/energy/postHeating/power"
+	topicPostHeatingTotal = "vallox/energy/postHeating/total"
+	topicFanPower         = "vallox/energy/fan/power"
+	topicFanEnergy        = "vallox/energy/fan/total"
+
+	energyInterval = 30 * time.Second
+
+	// heat capacity of air, density 1.2 kg/m³ * specific heat 1005 J/kgK, in Wh/m³K
+	airHeatCapacity = 1.2 * 1005 / 3600
+)
+
+type energyMeter struct {
+	name        string // key in persisted energy
+	powerTopic  string
+	energyTopic string
+	power       func(cache map[byte]cacheEntry) (float64, bool)
+	updated     time.Time
+}
+
+// newEnergyMeters enables estimators which have required configuration
+func newEnergyMeters(c Config, discovery map[string][]haEntity) []*energyMeter {
+	var energyMeters []*energyMeter
+	if len(c.Airflow) > 0 {
+		energyMeters = append(energyMeters, &energyMeter{
+			name:        "recovered",
+			powerTopic:  topicRecoveredPower,
+			energyTopic: topicRecoveredEnergy,
+			power: func(cache map[byte]cacheEntry) (float64, bool) {
+				return recoveredPower(c, cache)
+			},
+		})
+		discovery["sensor"] = append(discovery["sensor"],
+			haEntity{
+				UniqueId:          "vallox_recovered_power",
+				Name:              "Talteenotettu lämpöteho",
+				Device:            device,
+				DeviceClass:       "power",
+				StateClass:        "measurement",
+				StateTopic:        topicRecoveredPower,
+				UnitOfMeasurement: "W",
+			},
+			haEntity{
+				UniqueId:          "vallox_recovered_energy",
+				Name:              "Talteenotettu lämpöenergia",
+				Device:            device,
+				DeviceClass:       "energy",
+				StateClass:        "total_increasing",
+				StateTopic:        topicRecoveredEnergy,
+				UnitOfMeasurement: "kWh",
+			},
+		)
+	}
+	if c.PostHeaterPower > 0 {
+		energyMeters = append(energyMeters, &energyMeter{
+			name:        "postHeating",
+			powerTopic:  topicPostHeatingPower,
+			energyTopic: topicPostHeatingTotal,
+			power: func(cache map[byte]cacheEntry) (float64, bool) {
+				return postHeatingPower(c, cache)
+			},
+		})
+		discovery["sensor"] = append(discovery["sensor"],
+			haEntity{
+				UniqueId:          "vallox_post_heating_power",
+				Name:              "Jälkilämmityksen teho",
+				Device:            device,
+				DeviceClass:       "power",
+				StateClass:        "measurement",
+				StateTopic:        topicPostHeatingPower,
+				UnitOfMeasurement: "W",
+			},
+			haEntity{
+				UniqueId:          "vallox_post_heating_energy",
+				Name:              "Jälkilämmityksen energia",
+				Device:            device,
+				DeviceClass:       "energy",
+				StateClass:        "total_increasing",
+				StateTopic:        topicPostHeatingTotal,
+				UnitOfMeasurement: "kWh",
+			},
+		)
+	}
+	if len(c.FanPower) > 0 || c.FanPowerMax > 0 {
+		energyMeters = append(energyMeters, &energyMeter{
+			name:        "fan",
+			powerTopic:  topicFanPower,
+			energyTopic: topicFanEnergy,
+			power: func(cache map[byte]cacheEntry) (float64, bool) {
+				return fanPower(c, cache)
+			},
+		})
+		discovery["sensor"] = append(discovery["sensor"],
+			haEntity{
+				UniqueId:          "vallox_fan_power",
+				Name:              "Puhaltimien sähköteho",
+				Device:            device,
+				DeviceClass:       "power",
+				StateClass:        "measurement",
+				StateTopic:        topicFanPower,
+				UnitOfMeasurement: "W",
+			},
+			haEntity{
+				UniqueId:          "vallox_fan_energy",
+				Name:              "Puhaltimien sähkönkulutus",
+				Device:            device,
+				DeviceClass:       "energy",
+				StateClass:        "total_increasing",
+				StateTopic:        topicFanEnergy,
+				UnitOfMeasurement: "kWh",
+			},
+		)
+	}
+	return energyMeters
+}
+
+// updateEnergy accumulates energy of all meters since last update and publishes power and energy
+func (g *Gateway) updateEnergy(now time.Time) {
+	busSilent := now.Sub(g.lastEvent) > g.energyMaxGap
+
+	for _, meter := range g.energyMeters {
+		power, ok := meter.power(g.cache)
+		if busSilent || !ok {
+			meter.updated = time.Time{}
+			continue
+		}
+
+		if !meter.updated.IsZero() {
+			g.state.Energy[meter.name] += power * now.Sub(meter.updated).Hours() / 1000
+			g.state.dirty = true
+		}
+		meter.updated = now
+
+		go publish(g.mqtt, meter.powerTopic, fmt.Sprintf("%.0f", power))
+		go publish(g.mqtt, meter.energyTopic, fmt.Sprintf("%.3f", g.state.Energy[meter.name]))
+	}
+}
+
+// recoveredPower estimates heat recovered to supply air in watts from airflow of current speed
+func recoveredPower(c Config, cache map[byte]cacheEntry) (float64, bool) {
+	speed, ok := cachedNumber(cache, vallox.RegisterCurrentFanSpeed)
+	if !ok || speed < 1 || int(speed) > len(c.Airflow) {
+		return 0, false
+	}
+	outdoor, okOutdoor := cachedNumber(cache, vallox.RegisterOutdoorTemp)
+	supply, okSupply := cachedNumber(cache, vallox.RegisterSupplyTemp)
+	if !okOutdoor || !okSupply {
+		return 0, false
+	}
+
+	power := airHeatCapacity * c.Airflow[int(speed)-1] * (supply - outdoor)
+
+	// supply temperature is measured after the post heater
+	if heater, ok := postHeatingPower(c, cache); ok {
+		power -= heater
+	}
+
+	return math.Max(power, 0), true
+}
+
+// postHeatingPower estimates post heater power in watts from its on/off time ratio
+func postHeatingPower(c Config, cache map[byte]cacheEntry) (float64, bool) {
+	if c.PostHeaterPower <= 0 {
+		return 0, false
+	}
+	on, okOn := cachedNumber(cache, vallox.RegisterPostHeatingOnTime)
+	off, okOff := cachedNumber(cache, vallox.RegisterPostHeatingOffTime)
+	if !okOn || !okOff {
+		return 0, false
+	}
+	if on+off <= 0 {
+		return 0, true
+	}
+	return c.PostHeaterPower * on / (on + off), true
+}
+
+// fanPower estimates electrical power of both fans in watts,
+// from power table by speed or from DC fan control setpoints (%) and maximum fan power
+func fanPower(c Config, cache map[byte]cacheEntry) (float64, bool) {
+	if len(c.FanPower) > 0 {
+		speed, ok := cachedNumber(cache, vallox.RegisterCurrentFanSpeed)
+		if !ok || speed < 1 || int(speed) > len(c.FanPower) {
+			return 0, false
+		}
+		return c.FanPower[int(speed)-1], true
+	}
+
+	supply, okSupply := cachedNumber(cache, vallox.RegisterSupplyFanSetpoint)
+	exhaust, okExhaust := cachedNumber(cache, vallox.RegisterExhaustFanSetpoint)
+	if !okSupply || !okExhaust {
+		return 0, false
+	}
+	return c.FanPowerMax * (supply + exhaust) / 100, true
+}
+
+func cachedNumber(cache map[byte]cacheEntry, register byte) (float64, bool) {
+	cached, ok := cache[register]
+	if !ok {
+		return 0, false
+	}
+	return numericValue(cached.value.Value)
+}
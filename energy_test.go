@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+func testCache(values map[byte]int16) map[byte]cacheEntry {
+	cache := make(map[byte]cacheEntry)
+	for register, value := range values {
+		cache[register] = cacheEntry{time: time.Now(), value: vallox.Event{Register: register, RawValue: byte(value), Value: value}}
+	}
+	return cache
+}
+
+func TestEnergyPower(t *testing.T) {
+	airflow := []float64{20, 30, 40}
+	temps := map[byte]int16{
+		vallox.RegisterCurrentFanSpeed: 2,
+		vallox.RegisterOutdoorTemp:     5,
+		vallox.RegisterSupplyTemp:      18,
+	}
+	withHeater := func(on, off int16) map[byte]int16 {
+		values := map[byte]int16{vallox.RegisterPostHeatingOnTime: on, vallox.RegisterPostHeatingOffTime: off}
+		for register, value := range temps {
+			values[register] = value
+		}
+		return values
+	}
+
+	tests := []struct {
+		name   string
+		power  func(Config, map[byte]cacheEntry) (float64, bool)
+		config Config
+		values map[byte]int16
+		want   float64
+		ok     bool
+	}{
+		{"recovered", recoveredPower, Config{Airflow: airflow}, temps, airHeatCapacity * 30 * 13, true},
+		{"recovered without post heating", recoveredPower, Config{Airflow: airflow, PostHeaterPower: 1000}, withHeater(1, 9), airHeatCapacity*30*13 - 100, true},
+		{"recovered below post heating", recoveredPower, Config{Airflow: airflow, PostHeaterPower: 1000}, withHeater(9, 1), 0, true},
+		{"recovered speed without airflow", recoveredPower, Config{Airflow: airflow[:1]}, temps, 0, false},
+		{"recovered without temperature", recoveredPower, Config{Airflow: airflow}, map[byte]int16{vallox.RegisterCurrentFanSpeed: 2}, 0, false},
+		{"post heating", postHeatingPower, Config{PostHeaterPower: 1000}, withHeater(1, 3), 250, true},
+		{"post heating never on", postHeatingPower, Config{PostHeaterPower: 1000}, withHeater(0, 0), 0, true},
+		{"post heating without power", postHeatingPower, Config{}, withHeater(1, 3), 0, false},
+		{"fan power table", fanPower, Config{FanPower: []float64{10, 15, 20}}, map[byte]int16{vallox.RegisterCurrentFanSpeed: 3}, 20, true},
+		{"fan power over table", fanPower, Config{FanPower: []float64{10, 15, 20}}, map[byte]int16{vallox.RegisterCurrentFanSpeed: 4}, 0, false},
+		{"fan setpoints", fanPower, Config{FanPowerMax: 50}, map[byte]int16{vallox.RegisterSupplyFanSetpoint: 40, vallox.RegisterExhaustFanSetpoint: 60}, 50, true},
+		{"fan without setpoints", fanPower, Config{FanPowerMax: 50}, map[byte]int16{}, 0, false},
+	}
+	for _, test := range tests {
+		power, ok := test.power(test.config, testCache(test.values))
+		if ok != test.ok || math.Abs(power-test.want) > 1e-9 {
+			t.Errorf("%s: expected %v %v, got %v %v", test.name, test.want, test.ok, power, ok)
+		}
+	}
+}
+
+func TestUpdateEnergy(t *testing.T) {
+	g, _, mqtt := newTestGateway()
+	g.energyMeters = newEnergyMeters(Config{FanPower: []float64{50, 100}}, g.discovery)
+	g.energyMaxGap = 5 * time.Minute
+	g.cache = testCache(map[byte]int16{vallox.RegisterCurrentFanSpeed: 2})
+	start := time.Date(2024, 3, 12, 12, 0, 0, 0, time.Local)
+
+	update := func(lastEvent, now time.Duration) {
+		g.lastEvent = start.Add(lastEvent)
+		g.updateEnergy(start.Add(now))
+	}
+
+	update(0, 0)
+	if g.state.Energy["fan"] != 0 || g.state.dirty {
+		t.Fatalf("expected no energy on first update, got %v", g.state.Energy["fan"])
+	}
+
+	// 100 W for half an hour
+	update(30*time.Minute, 30*time.Minute)
+	if math.Abs(g.state.Energy["fan"]-0.05) > 1e-9 || !g.state.dirty {
+		t.Fatalf("expected 0.05 kWh, got %v", g.state.Energy["fan"])
+	}
+
+	// energy is not accumulated over silent bus
+	update(30*time.Minute, 2*time.Hour)
+	update(2*time.Hour, 2*time.Hour)
+	if math.Abs(g.state.Energy["fan"]-0.05) > 1e-9 {
+		t.Fatalf("expected no energy while bus was silent, got %v", g.state.Energy["fan"])
+	}
+
+	update(150*time.Minute, 150*time.Minute)
+	if math.Abs(g.state.Energy["fan"]-0.1) > 1e-9 {
+		t.Errorf("expected 0.1 kWh, got %v", g.state.Energy["fan"])
+	}
+	published := false
+	payloads := mqtt.waitFor(t, topicFanEnergy, 4)
+	for _, payload := range payloads {
+		published = published || payload == "0.100"
+	}
+	if !published {
+		t.Errorf("expected energy 0.100 to be published, got %v", payloads)
+	}
+}
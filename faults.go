@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+// Fault journal records raised and cleared faults and alarms.  Active faults and
+// the latest journal entries are kept in persistent state, so faults raised before
+// a restart are cleared with correct duration.
+
+const (
+	topicEvents       = "vallox/events"
+	topicFaultsActive = "vallox/faults/active"
+	topicFaultsCount  = "vallox/faults/count"
+	topicFaultsLast   = "vallox/faults/last"
+
+	faultJournalSize = 200
+)
+
+// faultEvent is a fault transition, published to topicEvents and kept in journal
+type faultEvent struct {
+	Fault    string    `json:"fault"`
+	Name     string    `json:"name"`
+	State    string    `json:"state"` // raised or cleared
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration,omitempty"` // seconds the fault was active, when cleared
+}
+
+type faultSource struct {
+	register byte
+	flag     byte
+	topic    string
+}
+
+var faultSources = []faultSource{
+	{vallox.RegisterFaultCode, vallox.FaultSupplyAirSensorFault, topicFaultSupplySensor},
+	{vallox.RegisterFaultCode, vallox.FaultCarbonDioxideAlarm, topicFaultCO2Alarm},
+	{vallox.RegisterFaultCode, vallox.FaultOutdoorSensorFault, topicFaultOutdoorSensor},
+	{vallox.RegisterFaultCode, vallox.FaultExhaustAirInSensorFault, topicFaultExhaustInSensor},
+	{vallox.RegisterFaultCode, vallox.FaultWaterCoilFreezing, topicFaultWaterCoilFreezing},
+	{vallox.RegisterFaultCode, vallox.FaultExhaustAirOutSensorFault, topicFaultExhaustOutSensor},
+	{vallox.RegisterFlags02, vallox.Flags2CO2Alarm, topicFlags2CO2Alarm},
+	{vallox.RegisterFlags02, vallox.Flags2CellFreezeAlarm, topicFlags2CellFreezeAlarm},
+	{vallox.RegisterStatus, vallox.StatusFlagFault, topicStatusFault},
+}
+
+// faultName returns name of the fault from discovery, or its topic
+func faultName(topic string) string {
+	for _, entry := range baseDiscovery["binary_sensor"] {
+		if entry.StateTopic == topic {
+			return entry.Name
+		}
+	}
+	return strings.TrimPrefix(topic, "vallox/")
+}
+
+// updateFaults records fault transitions when a fault register changes
+func updateFaults(mqtt publisher, persisted *persistentState, notifier *notifier, register byte, cache map[byte]cacheEntry) {
+	changed := false
+	for _, source := range faultSources {
+		if source.register != register {
+			continue
+		}
+		cached := cache[register]
+		fault := strings.TrimPrefix(source.topic, "vallox/")
+		active := cached.value.RawValue&source.flag == source.flag
+		raised, wasActive := persisted.Faults[fault]
+
+		event := faultEvent{Fault: fault, Name: faultName(source.topic), Time: cached.time}
+		if active && !wasActive {
+			event.State = "raised"
+			persisted.Faults[fault] = cached.time
+			notifier.notify(cache, "fault_"+fault, event.Name, fmt.Sprintf("%s raised at %s", event.Name, event.Time.Format(time.RFC3339)))
+		} else if !active && wasActive {
+			event.State = "cleared"
+			event.Duration = cached.time.Sub(raised).Seconds()
+			delete(persisted.Faults, fault)
+		} else {
+			continue
+		}
+
+		logInfo.Printf("fault %s %s", event.Name, event.State)
+		persisted.Journal = append(persisted.Journal, event)
+		if len(persisted.Journal) > faultJournalSize {
+			persisted.Journal = persisted.Journal[len(persisted.Journal)-faultJournalSize:]
+		}
+		persisted.dirty = true
+		changed = true
+
+		jsonmsg, err := json.Marshal(event)
+		if err != nil {
+			logError.Printf("Cannot marshal json %v", err)
+			continue
+		}
+		go publish(mqtt, topicEvents, jsonmsg)
+	}
+
+	if changed {
+		publishFaults(mqtt, persisted)
+	}
+}
+
+// publishFaults publishes active faults and summary of the latest transition
+func publishFaults(mqtt publisher, persisted *persistentState) {
+	var names []string
+	for fault := range persisted.Faults {
+		names = append(names, faultName("vallox/"+fault))
+	}
+	sort.Strings(names)
+
+	active := "none"
+	if len(names) > 0 {
+		active = strings.Join(names, ", ")
+	}
+	go publish(mqtt, topicFaultsActive, active)
+	go publish(mqtt, topicFaultsCount, fmt.Sprint(len(names)))
+
+	if len(persisted.Journal) > 0 {
+		last := persisted.Journal[len(persisted.Journal)-1]
+		go publish(mqtt, topicFaultsLast, fmt.Sprintf("%s %s %s", last.Name, last.State, last.Time.Format(time.RFC3339)))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+func TestFaultJournal(t *testing.T) {
+	start := time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)
+	outdoor := strings.TrimPrefix(topicFaultOutdoorSensor, "vallox/")
+	freezing := strings.TrimPrefix(topicFaultWaterCoilFreezing, "vallox/")
+
+	type transition struct {
+		fault    string
+		state    string
+		duration float64
+	}
+	steps := []struct {
+		name        string
+		register    byte
+		raw         byte
+		transitions []transition
+		active      int
+	}{
+		{"no faults", vallox.RegisterFaultCode, 0, nil, 0},
+		{"outdoor sensor", vallox.RegisterFaultCode, vallox.FaultOutdoorSensorFault, []transition{{outdoor, "raised", 0}}, 1},
+		{"unchanged", vallox.RegisterFaultCode, vallox.FaultOutdoorSensorFault, nil, 1},
+		{"other register", vallox.RegisterFlags02, 0, nil, 1},
+		{"freezing too", vallox.RegisterFaultCode, vallox.FaultOutdoorSensorFault | vallox.FaultWaterCoilFreezing, []transition{{freezing, "raised", 0}}, 2},
+		{"both cleared", vallox.RegisterFaultCode, 0, []transition{{outdoor, "cleared", 240}, {freezing, "cleared", 60}}, 0},
+	}
+
+	persisted := newPersistentState()
+	mqtt := &testPublisher{}
+	cache := make(map[byte]cacheEntry)
+	for i, step := range steps {
+		now := start.Add(time.Duration(i) * time.Minute)
+		cache[step.register] = cacheEntry{time: now, value: vallox.Event{Register: step.register, RawValue: step.raw}}
+		journal := len(persisted.Journal)
+
+		updateFaults(mqtt, persisted, newNotifier(Config{}), step.register, cache)
+
+		added := persisted.Journal[journal:]
+		if len(added) != len(step.transitions) {
+			t.Fatalf("%s: expected %d transitions, got %+v", step.name, len(step.transitions), added)
+		}
+		for j, want := range step.transitions {
+			got := added[j]
+			if got.Fault != want.fault || got.State != want.state || got.Duration != want.duration || !got.Time.Equal(now) {
+				t.Errorf("%s: expected %s %s after %vs at %v, got %+v", step.name, want.fault, want.state, want.duration, now, got)
+			}
+		}
+		if len(persisted.Faults) != step.active {
+			t.Errorf("%s: expected %d active faults, got %v", step.name, step.active, persisted.Faults)
+		}
+	}
+
+	events := mqtt.waitFor(t, topicEvents, 4)
+	for _, payload := range events {
+		var event faultEvent
+		if err := json.Unmarshal([]byte(payload), &event); err != nil || event.Name == "" || event.Name == event.Fault {
+			t.Errorf("expected event with name from discovery, got %s", payload)
+		}
+	}
+	if !persisted.dirty {
+		t.Errorf("expected journal to be saved")
+	}
+}
+
+// TestFaultClearedAfterRestart checks that fault raised before restart is cleared with its full duration
+func TestFaultClearedAfterRestart(t *testing.T) {
+	raised := time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)
+	fault := strings.TrimPrefix(topicFaultOutdoorSensor, "vallox/")
+	persisted := newPersistentState()
+	persisted.Faults[fault] = raised
+
+	mqtt := &testPublisher{}
+	publishFaults(mqtt, persisted)
+	if payloads := mqtt.waitFor(t, topicFaultsCount, 1); payloads[0] != "1" {
+		t.Errorf("expected fault from state to be active, got %v", payloads)
+	}
+
+	cache := map[byte]cacheEntry{vallox.RegisterFaultCode: {time: raised.Add(time.Hour), value: vallox.Event{Register: vallox.RegisterFaultCode}}}
+	updateFaults(mqtt, persisted, newNotifier(Config{}), vallox.RegisterFaultCode, cache)
+
+	if len(persisted.Journal) != 1 || persisted.Journal[0].State != "cleared" || persisted.Journal[0].Duration != 3600 {
+		t.Errorf("expected fault to be cleared after an hour, got %+v", persisted.Journal)
+	}
+	if payloads := mqtt.waitFor(t, topicFaultsActive, 2); !containsString(payloads, "none") {
+		t.Errorf("expected no active faults to be published, got %v", payloads)
+	}
+}
+
+func TestFaultJournalSize(t *testing.T) {
+	persisted := newPersistentState()
+	mqtt := &testPublisher{}
+	start := time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < faultJournalSize+10; i++ {
+		raw := byte(0)
+		if i%2 == 0 {
+			raw = vallox.FaultCarbonDioxideAlarm
+		}
+		cache := map[byte]cacheEntry{vallox.RegisterFaultCode: {time: start.Add(time.Duration(i) * time.Minute), value: vallox.Event{Register: vallox.RegisterFaultCode, RawValue: raw}}}
+		updateFaults(mqtt, persisted, newNotifier(Config{}), vallox.RegisterFaultCode, cache)
+	}
+
+	if len(persisted.Journal) != faultJournalSize {
+		t.Fatalf("expected journal of %d entries, got %d", faultJournalSize, len(persisted.Journal))
+	}
+	if last := persisted.Journal[len(persisted.Journal)-1]; !last.Time.Equal(start.Add(time.Duration(faultJournalSize+9) * time.Minute)) {
+		t.Errorf("expected latest transitions to be kept, last is %+v", last)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+// Frost protection supervisor lowers the fan speed before the heat exchanger freezes.
+// Protection activates on freeze alarms or when exhaust out temperature is below the
+// threshold, or is projected to fall below zero within lookahead time, while outdoor is
+// below outdoor limit.  While protection is active every speed request, boost included, is
+// capped to frost speed.  Supply speed is not lowered separately, vallox library can only
+// set the overall speed and supply fan setpoint would need register writes.
+
+const (
+	topicFrostActive = "vallox/frost/active"
+	topicFrostReason = "vallox/frost/reason"
+	topicFrostTrend  = "vallox/frost/trend"
+
+	// exhaust out temperature samples used for the trend
+	frostTrendWindow = 15 * time.Minute
+)
+
+type frostSample struct {
+	time time.Time
+	temp float64
+}
+
+// frostController supervises exhaust out temperature and freeze alarms
+type frostController struct {
+	enabled      bool
+	threshold    float64
+	hysteresis   float64
+	lookahead    time.Duration
+	outdoorLimit float64
+	speed        byte
+
+	samples []frostSample
+	active  bool
+}
+
+// newFrost creates frost protection from config, adding its entities to discovery when enabled
+func newFrost(c Config, discovery map[string][]haEntity) *frostController {
+	f := &frostController{
+		enabled:      c.FrostProtection,
+		threshold:    c.FrostThreshold,
+		hysteresis:   c.FrostHysteresis,
+		lookahead:    c.FrostLookahead,
+		outdoorLimit: c.FrostOutdoorLimit,
+		speed:        c.FrostSpeed,
+	}
+	if !f.enabled {
+		return f
+	}
+
+	logInfo.Printf("frost protection below %.1f°C exhaust out temperature", f.threshold)
+
+	discovery["binary_sensor"] = append(discovery["binary_sensor"],
+		haEntity{
+			UniqueId:    "vallox_frost_active",
+			Name:        "Jäätymisenesto",
+			Device:      device,
+			DeviceClass: "problem",
+			StateTopic:  topicFrostActive,
+			PayloadOn:   "true",
+			PayloadOff:  "false",
+		},
+	)
+	discovery["sensor"] = append(discovery["sensor"],
+		haEntity{
+			UniqueId:   "vallox_frost_reason",
+			Name:       "Jäätymiseneston syy",
+			Device:     device,
+			Icon:       "mdi:snowflake-alert",
+			StateTopic: topicFrostReason,
+		},
+		haEntity{
+			UniqueId:          "vallox_frost_trend",
+			Name:              "Jäteilman lämpötilan muutos",
+			Device:            device,
+			Icon:              "mdi:thermometer-chevron-down",
+			StateClass:        "measurement",
+			StateTopic:        topicFrostTrend,
+			UnitOfMeasurement: "°C/h",
+		},
+	)
+	return f
+}
+
+// reason returns why protection is needed, empty when it is not
+func (f *frostController) reason(cache map[byte]cacheEntry, trend float64, okTrend bool) string {
+	flags := []struct {
+		register byte
+		flag     byte
+		reason   string
+	}{
+		{vallox.RegisterFlags02, vallox.Flags2CellFreezeAlarm, "cell freeze alarm"},
+		{vallox.RegisterFlags04, vallox.Flags4WaterCoilFreezing, "water coil freezing"},
+		{vallox.RegisterFaultCode, vallox.FaultWaterCoilFreezing, "water coil freezing fault"},
+	}
+	for _, alarm := range flags {
+		if cached, ok := cache[alarm.register]; ok && cached.value.RawValue&alarm.flag == alarm.flag {
+			return alarm.reason
+		}
+	}
+
+	exhaustOut, okExhaust := cachedNumber(cache, vallox.RegisterExhaustOutTemp)
+	outdoor, okOutdoor := cachedNumber(cache, vallox.RegisterOutdoorTemp)
+	if !okExhaust || !okOutdoor || outdoor >= f.outdoorLimit {
+		return ""
+	}
+
+	threshold := f.threshold
+	if f.active {
+		threshold += f.hysteresis
+	}
+	if exhaustOut < threshold {
+		return fmt.Sprintf("exhaust out %.0f°C", exhaustOut)
+	}
+	if okTrend && exhaustOut+trend*f.lookahead.Hours() < 0 {
+		return fmt.Sprintf("exhaust out %.0f°C falling %.1f°C/h", exhaustOut, trend)
+	}
+	return ""
+}
+
+// frostTrend returns exhaust out temperature change in °C/h as least squares slope
+func frostTrend(samples []frostSample) (float64, bool) {
+	if len(samples) < 2 || samples[len(samples)-1].time.Sub(samples[0].time) < frostTrendWindow/3 {
+		return 0, false
+	}
+
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range samples {
+		x := s.time.Sub(samples[0].time).Hours()
+		sumX += x
+		sumY += s.temp
+		sumXY += x * s.temp
+		sumXX += x * x
+	}
+	n := float64(len(samples))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, false
+	}
+	return (n*sumXY - sumX*sumY) / denominator, true
+}
+
+// update samples exhaust out temperature and starts or ends protection
+func (f *frostController) update(mqtt publisher, cache map[byte]cacheEntry, now time.Time) {
+	if !f.enabled {
+		return
+	}
+
+	if temp, ok := cachedNumber(cache, vallox.RegisterExhaustOutTemp); ok {
+		f.samples = append(f.samples, frostSample{time: now, temp: temp})
+	}
+	for len(f.samples) > 0 && now.Sub(f.samples[0].time) > frostTrendWindow {
+		f.samples = f.samples[1:]
+	}
+
+	trend, okTrend := frostTrend(f.samples)
+	reason := f.reason(cache, trend, okTrend)
+
+	if !f.active && reason != "" {
+		logInfo.Printf("frost protection activated: %s", reason)
+		f.active = true
+	} else if f.active && reason == "" {
+		logInfo.Printf("frost protection ended")
+		f.active = false
+	}
+
+	if okTrend {
+		go publish(mqtt, topicFrostTrend, fmt.Sprintf("%.1f", trend))
+	}
+	if reason == "" {
+		reason = "none"
+	}
+	go publish(mqtt, topicFrostReason, reason)
+	go publish(mqtt, topicFrostActive, fmt.Sprint(f.active))
+}
+
+// cap replaces request faster than frost speed with frost speed while protection is active
+func (f *frostController) cap(request speedRequest) speedRequest {
+	if f.active && request.speed > f.speed {
+		return speedRequest{source: speedSourceFrost, speed: f.speed}
+	}
+	return request
+}
+
+// limit limits speed queued to the unit while protection is active
+func (f *frostController) limit(speed byte) byte {
+	if f.active && speed > f.speed {
+		logInfo.Printf("frost protection active, limiting requested speed %d to %d", speed, f.speed)
+		return f.speed
+	}
+	return speed
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+func newTestFrost() *frostController {
+	return newFrost(Config{
+		FrostProtection:   true,
+		FrostThreshold:    2,
+		FrostHysteresis:   2,
+		FrostLookahead:    30 * time.Minute,
+		FrostOutdoorLimit: 0,
+		FrostSpeed:        1,
+	}, make(map[string][]haEntity))
+}
+
+func TestFrostTrend(t *testing.T) {
+	start := time.Date(2024, 1, 12, 12, 0, 0, 0, time.Local)
+	samples := func(temps ...float64) []frostSample {
+		var samples []frostSample
+		for i, temp := range temps {
+			samples = append(samples, frostSample{time: start.Add(time.Duration(i) * time.Minute), temp: temp})
+		}
+		return samples
+	}
+
+	tests := []struct {
+		name    string
+		samples []frostSample
+		trend   float64
+		ok      bool
+	}{
+		{"no samples", nil, 0, false},
+		{"one sample", samples(5), 0, false},
+		{"window too short", samples(5, 4, 3, 2), 0, false},
+		{"falling", samples(6, 5.9, 5.8, 5.7, 5.6, 5.5), -6, true},
+		{"steady", samples(3, 3, 3, 3, 3, 3), 0, true},
+		{"noisy rising", samples(3, 4, 3, 4, 5, 4, 5), 120.0 / 7, true},
+	}
+	for _, test := range tests {
+		trend, ok := frostTrend(test.samples)
+		if ok != test.ok || math.Abs(trend-test.trend) > 1e-6 {
+			t.Errorf("%s: expected %v %v, got %v %v", test.name, test.trend, test.ok, trend, ok)
+		}
+	}
+}
+
+func TestFrostUpdate(t *testing.T) {
+	start := time.Date(2024, 1, 12, 12, 0, 0, 0, time.Local)
+
+	// each step continues from the state of the previous one, one step per minute
+	steps := []struct {
+		name       string
+		exhaustOut int16
+		outdoor    int16
+		alarm      byte // fault code
+		active     bool
+	}{
+		{"warm", 8, -10, 0, false},
+		{"mild outdoor", 1, 0, 0, false},
+		{"below threshold", 1, -10, 0, true},
+		{"within hysteresis", 3, -10, 0, true},
+		{"above hysteresis", 4, -10, 0, false},
+		{"freeze alarm", 8, -10, vallox.FaultWaterCoilFreezing, true},
+		{"alarm cleared", 8, -10, 0, false},
+	}
+
+	f := newTestFrost()
+	mqtt := &testPublisher{}
+	for i, step := range steps {
+		cache := testCache(map[byte]int16{vallox.RegisterExhaustOutTemp: step.exhaustOut, vallox.RegisterOutdoorTemp: step.outdoor})
+		cache[vallox.RegisterFaultCode] = cacheEntry{value: vallox.Event{Register: vallox.RegisterFaultCode, RawValue: step.alarm}}
+		f.update(mqtt, cache, start.Add(time.Duration(i)*time.Minute))
+		if f.active != step.active {
+			t.Errorf("%s: expected active %v, got %v", step.name, step.active, f.active)
+		}
+	}
+}
+
+func TestFrostProjectedTrend(t *testing.T) {
+	f := newTestFrost()
+	mqtt := &testPublisher{}
+	start := time.Date(2024, 1, 12, 12, 0, 0, 0, time.Local)
+
+	// exhaust out falls 12°C/h, reaching zero within lookahead from 5°C
+	temps := []int16{9, 9, 8, 8, 7, 7}
+	for i, temp := range temps {
+		f.update(mqtt, testCache(map[byte]int16{vallox.RegisterExhaustOutTemp: temp, vallox.RegisterOutdoorTemp: -10}), start.Add(time.Duration(i)*time.Minute*2))
+	}
+	if f.active {
+		t.Fatalf("expected no protection while projection stays above zero")
+	}
+	for i, temp := range []int16{6, 6, 5} {
+		f.update(mqtt, testCache(map[byte]int16{vallox.RegisterExhaustOutTemp: temp, vallox.RegisterOutdoorTemp: -10}), start.Add(time.Duration(len(temps)+i)*time.Minute*2))
+	}
+	if !f.active {
+		t.Errorf("expected protection when temperature is projected below zero")
+	}
+
+	// samples older than trend window are dropped
+	if age := start.Add(16 * time.Minute).Sub(f.samples[0].time); age > frostTrendWindow {
+		t.Errorf("expected samples within trend window, oldest is %v old", age)
+	}
+}
+
+func TestFrostLimit(t *testing.T) {
+	f := newTestFrost()
+	tests := []struct {
+		active    bool
+		requested byte
+		limited   byte
+	}{
+		{false, 5, 5},
+		{true, 5, 1},
+		{true, 1, 1},
+	}
+	for _, test := range tests {
+		f.active = test.active
+		if limited := f.limit(test.requested); limited != test.limited {
+			t.Errorf("active %v: expected %d to be limited to %d, got %d", test.active, test.requested, test.limited, limited)
+		}
+	}
+}
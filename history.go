@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	mqttClient "github.com/eclipse/paho.mqtt.golang"
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+// History is stored as one json line per value in daily files,
+// raw values under <dir>/raw and averages under <dir>/avg.  Raw values are
+// stored when they change, averages are taken over every received value.
+// Retention is handled by removing whole daily files.
+
+const (
+	topicHistoryGet    = "vallox/history/get"
+	topicHistoryResult = "vallox/history/result"
+
+	// response topics of requests must be under this prefix
+	historyResponsePrefix = "vallox/history/"
+
+	historyRaw        = "raw"
+	historyDownsample = "avg"
+	historyDayLayout  = "2006-01-02"
+
+	// limits of a single history query, longer results are continued from next
+	historyMaxRange   = 31 * 24 * time.Hour
+	historyMaxRecords = 5000
+)
+
+// historyRecord is a single stored value, topic is without vallox/ prefix
+type historyRecord struct {
+	Time  time.Time `json:"t"`
+	Topic string    `json:"topic"`
+	Value float64   `json:"v"`
+	Min   *float64  `json:"min,omitempty"`
+	Max   *float64  `json:"max,omitempty"`
+}
+
+// historyRequest is received from topicHistoryGet, resolution is raw or avg
+type historyRequest struct {
+	Topic         string    `json:"topic"`
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	Resolution    string    `json:"resolution"`
+	ResponseTopic string    `json:"response_topic"`
+}
+
+type historyResponse struct {
+	Request historyRequest  `json:"request"`
+	Records []historyRecord `json:"records"`
+	Next    *time.Time      `json:"next,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+type historyBucket struct {
+	sum   float64
+	count int
+	min   float64
+	max   float64
+}
+
+// historyStore stores values to daily files under dir, record queues values to the
+// recording loop which owns the buckets and last stored values
+type historyStore struct {
+	dir          string
+	rawRetention time.Duration
+	retention    time.Duration
+	interval     time.Duration
+	maxRecords   int
+
+	records     chan historyRecord
+	buckets     map[string]*historyBucket
+	bucketStart time.Time
+	last        map[string]historyRecord // last raw record by topic
+}
+
+// newHistory creates history store in HISTORY_DIR
+func newHistory(c Config) *historyStore {
+	for _, resolution := range []string{historyRaw, historyDownsample} {
+		if err := os.MkdirAll(filepath.Join(c.HistoryDir, resolution), 0755); err != nil {
+			logError.Fatalf("cannot create history directory %s: %v", c.HistoryDir, err)
+		}
+	}
+
+	logInfo.Printf("storing history to %s", c.HistoryDir)
+
+	return &historyStore{
+		dir:          c.HistoryDir,
+		rawRetention: c.HistoryRawRetention,
+		retention:    c.HistoryRetention,
+		interval:     c.HistoryDownsampleInterval,
+		maxRecords:   historyMaxRecords,
+		records:      make(chan historyRecord, 100),
+		buckets:      make(map[string]*historyBucket),
+		bucketStart:  time.Now().Truncate(c.HistoryDownsampleInterval),
+		last:         make(map[string]historyRecord),
+	}
+}
+
+func (h *historyStore) run() {
+	ticker := time.NewTicker(time.Minute)
+	h.prune(time.Now())
+
+	for {
+		select {
+		case record := <-h.records:
+			h.add(record)
+		case now := <-ticker.C:
+			h.tick(now)
+		}
+	}
+}
+
+// add stores the value as raw record when it has changed or the last raw record is older
+// than downsample interval, so ranges have values, and adds it to the average
+func (h *historyStore) add(record historyRecord) {
+	last, ok := h.last[record.Topic]
+	if !ok || last.Value != record.Value || record.Time.Sub(last.Time) >= h.interval {
+		h.append(historyRaw, record)
+		h.last[record.Topic] = record
+	}
+
+	bucket, ok := h.buckets[record.Topic]
+	if !ok {
+		bucket = &historyBucket{min: record.Value, max: record.Value}
+		h.buckets[record.Topic] = bucket
+	}
+	bucket.add(record.Value)
+}
+
+// tick stores averages and removes expired history when downsample interval has passed
+func (h *historyStore) tick(now time.Time) {
+	if now.Sub(h.bucketStart) < h.interval {
+		return
+	}
+	h.flush(h.bucketStart)
+	h.buckets = make(map[string]*historyBucket)
+	h.bucketStart = now.Truncate(h.interval)
+	h.prune(now)
+}
+
+// serve reads requested history and publishes the response, queries are
+// served outside the recording loop so a long read does not delay recording
+func (h *historyStore) serve(mqtt publisher, request historyRequest) {
+	response := historyResponse{Request: request}
+	if err := checkHistoryResponseTopic(request.ResponseTopic); err != nil {
+		response.Request.ResponseTopic = ""
+		response.Error = err.Error()
+		publishHistoryResponse(mqtt, response)
+		return
+	}
+	records, next, err := h.read(request)
+	if err != nil {
+		response.Error = err.Error()
+	}
+	response.Records = records
+	if !next.IsZero() {
+		response.Next = &next
+	}
+	publishHistoryResponse(mqtt, response)
+}
+
+func (b *historyBucket) add(value float64) {
+	b.sum += value
+	b.count++
+	if value < b.min {
+		b.min = value
+	}
+	if value > b.max {
+		b.max = value
+	}
+}
+
+// record queues numeric values of the event to history
+func (h *historyStore) record(event vallox.Event, cache map[byte]cacheEntry, t time.Time) {
+	values := make(map[string]interface{})
+	for topic, value := range eventValues(event) {
+		values[topic] = value
+	}
+	// cache is not yet updated with this event, so combine lower byte with the cached upper byte
+	for _, e := range registry {
+		if !e.isWord() || e.low != event.Register {
+			continue
+		}
+		entries := map[byte]cacheEntry{event.Register: {time: t, value: event}}
+		if cached, ok := cache[e.register]; ok {
+			entries[e.register] = cached
+		}
+		if value, ok := wordValue(e, entries); ok {
+			values[e.topic] = value
+		}
+	}
+
+	for topic, value := range values {
+		number, ok := numericValue(value)
+		if !ok {
+			continue
+		}
+		record := historyRecord{Time: t, Topic: strings.TrimPrefix(topic, "vallox/"), Value: number}
+		select {
+		case h.records <- record:
+		default:
+			logError.Printf("history queue full, dropping %s", record.Topic)
+		}
+	}
+}
+
+func (h *historyStore) flush(start time.Time) {
+	for topic, bucket := range h.buckets {
+		min, max := bucket.min, bucket.max
+		h.append(historyDownsample, historyRecord{
+			Time:  start,
+			Topic: topic,
+			Value: bucket.sum / float64(bucket.count),
+			Min:   &min,
+			Max:   &max,
+		})
+	}
+}
+
+func (h *historyStore) file(resolution string, day time.Time) string {
+	return filepath.Join(h.dir, resolution, day.Format(historyDayLayout)+".jsonl")
+}
+
+func (h *historyStore) append(resolution string, record historyRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		logError.Printf("Cannot marshal json %v", err)
+		return
+	}
+
+	f, err := os.OpenFile(h.file(resolution, record.Time), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logError.Printf("cannot open history file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		logError.Printf("cannot write history: %v", err)
+	}
+}
+
+// prune removes daily files older than retention
+func (h *historyStore) prune(now time.Time) {
+	retention := map[string]time.Duration{
+		historyRaw:        h.rawRetention,
+		historyDownsample: h.retention,
+	}
+	for resolution, keep := range retention {
+		files, err := filepath.Glob(filepath.Join(h.dir, resolution, "*.jsonl"))
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			day, err := time.ParseInLocation(historyDayLayout, strings.TrimSuffix(filepath.Base(file), ".jsonl"), time.Local)
+			if err != nil {
+				continue
+			}
+			// whole day must be past retention
+			if now.Sub(day.AddDate(0, 0, 1)) > keep {
+				logDebug.Printf("removing expired history %s", file)
+				if err := os.Remove(file); err != nil {
+					logError.Printf("cannot remove history %s: %v", file, err)
+				}
+			}
+		}
+	}
+}
+
+// read returns at most maxRecords records of the request.  When there are more, next is the
+// time to continue from, it is zero when all records were returned.
+func (h *historyStore) read(request historyRequest) (records []historyRecord, next time.Time, err error) {
+	if request.Resolution == "" {
+		request.Resolution = historyDownsample
+	}
+	if request.Resolution != historyRaw && request.Resolution != historyDownsample {
+		return nil, next, fmt.Errorf("unknown resolution %s", request.Resolution)
+	}
+	if request.To.IsZero() {
+		request.To = time.Now()
+	}
+	if request.From.IsZero() {
+		request.From = request.To.Add(-24 * time.Hour)
+	}
+	if request.To.Before(request.From) {
+		return nil, next, fmt.Errorf("to is before from")
+	}
+	if request.To.Sub(request.From) > historyMaxRange {
+		return nil, next, fmt.Errorf("range is longer than %v", historyMaxRange)
+	}
+	topic := strings.TrimPrefix(request.Topic, "vallox/")
+
+	records = []historyRecord{}
+	from := request.From.In(time.Local)
+	// daily files do not overlap, so reading can stop after the day that filled the limit
+	for day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.Local); !day.After(request.To) && len(records) <= h.maxRecords; day = day.AddDate(0, 0, 1) {
+		f, err := os.Open(h.file(request.Resolution, day))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return records, next, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var record historyRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				continue
+			}
+			if (topic == "" || record.Topic == topic) && !record.Time.Before(request.From) && !record.Time.After(request.To) {
+				records = append(records, record)
+			}
+		}
+		f.Close()
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	if len(records) <= h.maxRecords {
+		return records, next, nil
+	}
+
+	// cut before records sharing the time of the first omitted one, they are returned
+	// by the request continuing from next
+	next = records[h.maxRecords].Time
+	cut := h.maxRecords
+	for cut > 0 && records[cut-1].Time.Equal(next) {
+		cut--
+	}
+	if cut == 0 {
+		cut = h.maxRecords
+	}
+	return records[:cut], next, nil
+}
+
+// checkHistoryResponseTopic allows response topics under vallox/history/, so requests can not
+// publish to topics of other devices or back to the request topic
+func checkHistoryResponseTopic(topic string) error {
+	if topic == "" {
+		return nil
+	}
+	if !strings.HasPrefix(topic, historyResponsePrefix) || topic == historyResponsePrefix ||
+		topic == topicHistoryGet || strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("response topic %s should be under %s", topic, historyResponsePrefix)
+	}
+	return nil
+}
+
+func publishHistoryResponse(mqtt publisher, response historyResponse) {
+	jsonmsg, err := json.Marshal(response)
+	if err != nil {
+		logError.Printf("Cannot marshal json %v", err)
+		return
+	}
+
+	topic := topicHistoryResult
+	if response.Request.ResponseTopic != "" {
+		topic = response.Request.ResponseTopic
+	}
+	publish(mqtt, topic, jsonmsg)
+}
+
+func (h *historyStore) requestMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
+	var request historyRequest
+	if err := json.Unmarshal(msg.Payload(), &request); err != nil {
+		logError.Printf("cannot parse history request %s: %v", msg.Payload(), err)
+		return
+	}
+	go h.serve(mqtt, request)
+}
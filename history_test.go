@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCheckHistoryResponseTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		valid bool
+	}{
+		{"", true},
+		{"vallox/history/dashboard", true},
+		{"vallox/history/", false},
+		{topicHistoryGet, false},
+		{"vallox/history/#", false},
+		{"vallox/fan/set", false},
+		{"zigbee2mqtt/bridge/request/restart", false},
+	}
+	for _, test := range tests {
+		if err := checkHistoryResponseTopic(test.topic); (err == nil) != test.valid {
+			t.Errorf("%q: expected valid %v, got %v", test.topic, test.valid, err)
+		}
+	}
+}
+
+func newTestHistory(t *testing.T) *historyStore {
+	return newHistory(Config{
+		HistoryDir:                t.TempDir(),
+		HistoryRawRetention:       48 * time.Hour,
+		HistoryRetention:          240 * time.Hour,
+		HistoryDownsampleInterval: 5 * time.Minute,
+	})
+}
+
+func readTestHistory(t *testing.T, h *historyStore, request historyRequest) []historyRecord {
+	t.Helper()
+	records, _, err := h.read(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestHistoryChangedValuesOnly(t *testing.T) {
+	h := newTestHistory(t)
+	start := time.Date(2024, 3, 12, 12, 0, 0, 0, time.Local)
+
+	for _, record := range []historyRecord{
+		{Time: start, Topic: "temp/outdoor", Value: 20},
+		{Time: start.Add(time.Minute), Topic: "temp/outdoor", Value: 20},
+		{Time: start.Add(2 * time.Minute), Topic: "temp/outdoor", Value: 21},
+		{Time: start.Add(3 * time.Minute), Topic: "temp/outdoor", Value: 21},
+		{Time: start.Add(3 * time.Minute), Topic: "temp/supply", Value: 21},
+		// unchanged value is stored again after downsample interval
+		{Time: start.Add(7 * time.Minute), Topic: "temp/outdoor", Value: 21},
+	} {
+		h.add(record)
+	}
+
+	records := readTestHistory(t, h, historyRequest{Topic: "vallox/temp/outdoor", From: start, To: start.Add(time.Hour), Resolution: historyRaw})
+	want := []time.Duration{0, 2 * time.Minute, 7 * time.Minute}
+	if len(records) != len(want) {
+		t.Fatalf("expected %d raw records, got %v", len(want), records)
+	}
+	for i, record := range records {
+		if !record.Time.Equal(start.Add(want[i])) {
+			t.Errorf("expected record %d at %v, got %v", i, start.Add(want[i]), record.Time)
+		}
+	}
+}
+
+func TestHistoryBuckets(t *testing.T) {
+	h := newTestHistory(t)
+	start := time.Date(2024, 3, 12, 12, 0, 0, 0, time.Local)
+	h.bucketStart = start
+
+	for i, value := range []float64{20, 20, 24, 22} {
+		h.add(historyRecord{Time: start.Add(time.Duration(i) * time.Minute), Topic: "temp/outdoor", Value: value})
+	}
+
+	h.tick(start.Add(4 * time.Minute))
+	request := historyRequest{Topic: "temp/outdoor", From: start, To: start.Add(time.Hour), Resolution: historyDownsample}
+	if records := readTestHistory(t, h, request); len(records) != 0 {
+		t.Fatalf("expected no averages before interval has passed, got %v", records)
+	}
+
+	h.tick(start.Add(5 * time.Minute))
+	records := readTestHistory(t, h, request)
+	if len(records) != 1 {
+		t.Fatalf("expected one average, got %v", records)
+	}
+	record := records[0]
+	if !record.Time.Equal(start) || record.Value != 21.5 || *record.Min != 20 || *record.Max != 24 {
+		t.Errorf("expected average 21.5 (20-24) at %v, got %v (%v-%v) at %v", start, record.Value, *record.Min, *record.Max, record.Time)
+	}
+	if !h.bucketStart.Equal(start.Add(5*time.Minute)) || len(h.buckets) != 0 {
+		t.Errorf("expected new empty bucket, got %v %v", h.bucketStart, h.buckets)
+	}
+}
+
+func TestHistoryPrune(t *testing.T) {
+	h := newTestHistory(t)
+	now := time.Date(2024, 3, 12, 12, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		resolution string
+		daysAgo    int
+		kept       bool
+	}{
+		{historyRaw, 0, true},
+		{historyRaw, 1, true},
+		{historyRaw, 3, false},
+		{historyDownsample, 3, true},
+		{historyDownsample, 9, true},
+		{historyDownsample, 11, false},
+	}
+	for _, test := range tests {
+		h.append(test.resolution, historyRecord{Time: now.AddDate(0, 0, -test.daysAgo), Topic: "temp/outdoor", Value: 1})
+	}
+
+	h.prune(now)
+
+	for _, test := range tests {
+		file := h.file(test.resolution, now.AddDate(0, 0, -test.daysAgo))
+		if _, err := os.Stat(file); (err == nil) != test.kept {
+			t.Errorf("%s %d days ago: expected kept %v, got %v", test.resolution, test.daysAgo, test.kept, err)
+		}
+	}
+}
+
+func TestHistoryRead(t *testing.T) {
+	h := newTestHistory(t)
+	start := time.Date(2024, 3, 12, 22, 0, 0, 0, time.Local)
+
+	// records over midnight are in two daily files, written out of order
+	for _, offset := range []time.Duration{3 * time.Hour, time.Hour, 0, 2 * time.Hour, 4 * time.Hour} {
+		h.append(historyRaw, historyRecord{Time: start.Add(offset), Topic: "temp/outdoor", Value: float64(offset / time.Hour)})
+		h.append(historyRaw, historyRecord{Time: start.Add(offset), Topic: "temp/supply", Value: 20})
+	}
+
+	tests := []struct {
+		request historyRequest
+		values  []float64
+	}{
+		{historyRequest{Topic: "temp/outdoor", From: start.Add(time.Hour), To: start.Add(3 * time.Hour), Resolution: historyRaw}, []float64{1, 2, 3}},
+		{historyRequest{Topic: "vallox/temp/outdoor", From: start.Add(-time.Hour), To: start.Add(90 * time.Minute), Resolution: historyRaw}, []float64{0, 1}},
+		{historyRequest{Topic: "temp/outdoor", From: start.Add(5 * time.Hour), To: start.Add(6 * time.Hour), Resolution: historyRaw}, []float64{}},
+		{historyRequest{Topic: "temp/outdoor", From: start, To: start.Add(4 * time.Hour)}, []float64{}},
+	}
+	for _, test := range tests {
+		records := readTestHistory(t, h, test.request)
+		values := []float64{}
+		for _, record := range records {
+			values = append(values, record.Value)
+		}
+		if fmt.Sprint(values) != fmt.Sprint(test.values) {
+			t.Errorf("%+v: expected %v, got %v", test.request, test.values, values)
+		}
+	}
+
+	for _, request := range []historyRequest{
+		{Resolution: "hourly"},
+		{From: start, To: start.Add(-time.Hour)},
+		{From: start, To: start.Add(historyMaxRange + time.Hour)},
+	} {
+		if _, _, err := h.read(request); err == nil {
+			t.Errorf("%+v: expected request to fail", request)
+		}
+	}
+}
+
+func TestHistoryReadLimit(t *testing.T) {
+	h := newTestHistory(t)
+	h.maxRecords = 3
+	start := time.Date(2024, 3, 12, 22, 0, 0, 0, time.Local)
+
+	// two topics per hour, over midnight
+	for hour := 0; hour < 4; hour++ {
+		for _, topic := range []string{"temp/outdoor", "temp/supply"} {
+			h.append(historyRaw, historyRecord{Time: start.Add(time.Duration(hour) * time.Hour), Topic: topic, Value: float64(hour)})
+		}
+	}
+
+	request := historyRequest{From: start, To: start.Add(4 * time.Hour), Resolution: historyRaw}
+	values := []float64{}
+	for pages := 0; ; pages++ {
+		if pages > 4 {
+			t.Fatalf("expected reading to end, got %v", values)
+		}
+		records, next, err := h.read(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) > h.maxRecords {
+			t.Fatalf("expected at most %d records, got %d", h.maxRecords, len(records))
+		}
+		for _, record := range records {
+			values = append(values, record.Value)
+		}
+		if next.IsZero() {
+			break
+		}
+		request.From = next
+	}
+
+	// records of the same time are not split between responses
+	if fmt.Sprint(values) != fmt.Sprint([]float64{0, 0, 1, 1, 2, 2, 3, 3}) {
+		t.Errorf("expected every record once, got %v", values)
+	}
+}
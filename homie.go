@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	mqttClient "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Homie 4 convention, see https://homieiot.github.io/specification/
+
+const (
+	homieVersion = "4.0"
+	homieBase    = "homie/vallox"
+)
+
+type homieNode struct {
+	id   string
+	name string
+}
+
+type homieProperty struct {
+	node     homieNode
+	id       string
+	name     string
+	datatype string
+	unit     string
+	format   string
+	settable bool
+}
+
+var (
+	homieNodeTemperatures = homieNode{id: "temperatures", name: "Temperatures"}
+	homieNodeFan          = homieNode{id: "fan", name: "Fan"}
+	homieNodeFaults       = homieNode{id: "faults", name: "Faults"}
+	homieNodeSensors      = homieNode{id: "sensors", name: "Sensors"}
+	homieNodeFlags        = homieNode{id: "flags", name: "Flags"}
+	homieNodeSettings     = homieNode{id: "settings", name: "Settings"}
+
+	homieNodes = []homieNode{
+		homieNodeTemperatures,
+		homieNodeFan,
+		homieNodeFaults,
+		homieNodeSensors,
+		homieNodeFlags,
+		homieNodeSettings,
+	}
+)
+
+// homieNodeByGroup maps first topic level after vallox/ to a node, everything else is a setting
+var homieNodeByGroup = map[string]homieNode{
+	"temp":    homieNodeTemperatures,
+	"fan":     homieNodeFan,
+	"fault":   homieNodeFaults,
+	"rh":      homieNodeSensors,
+	"co2":     homieNodeSensors,
+	"message": homieNodeSensors,
+}
+
+// homieProperties by vallox topic, built from registry
+var homieProperties = buildHomieProperties()
+
+func buildHomieProperties() map[string]homieProperty {
+	properties := make(map[string]homieProperty)
+
+	for _, e := range registry {
+		datatype := "integer"
+		if e.flag != 0 {
+			datatype = "boolean"
+		}
+		properties[e.topic] = newHomieProperty(e.topic, datatype)
+	}
+
+	return properties
+}
+
+func newHomieProperty(topic string, datatype string) homieProperty {
+	levels := strings.Split(strings.TrimPrefix(topic, "vallox/"), "/")
+
+	node, ok := homieNodeByGroup[levels[0]]
+	if datatype == "boolean" && node != homieNodeFaults {
+		node = homieNodeFlags
+	} else if !ok {
+		node = homieNodeSettings
+	}
+	if node == homieNodeTemperatures || node == homieNodeFan || node == homieNodeFaults {
+		levels = levels[1:] // group is already named by the node
+	}
+
+	ids := make([]string, len(levels))
+	for i, level := range levels {
+		ids[i] = homieID(level)
+	}
+
+	property := homieProperty{
+		node:     node,
+		id:       strings.Join(ids, "-"),
+		name:     topic,
+		datatype: datatype,
+	}
+
+	// Reuse names and units from home assistant discovery when available
+	for _, entries := range baseDiscovery {
+		for _, entry := range entries {
+			if entry.StateTopic != topic {
+				continue
+			}
+			property.name = entry.Name
+			if entry.UnitOfMeasurement != "" {
+				property.unit = entry.UnitOfMeasurement
+			}
+			if entry.CommandTopic != "" && entry.haRange != nil {
+				property.settable = true
+				property.format = fmt.Sprintf("%v:%v", entry.Min, entry.Max)
+			}
+		}
+	}
+
+	return property
+}
+
+// homieID converts camelCase topic level to homie compatible lower case id
+func homieID(level string) string {
+	runes := []rune(level)
+	var id strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				id.WriteRune('-')
+			}
+		}
+		id.WriteRune(unicode.ToLower(r))
+	}
+	return id.String()
+}
+
+func (p homieProperty) topic() string {
+	return fmt.Sprintf("%s/%s/%s", homieBase, p.node.id, p.id)
+}
+
+// announceHomie publishes device, node and property attributes
+func announceHomie(mqtt publisher) {
+	publishRetained(mqtt, homieBase+"/$state", "init")
+	publishRetained(mqtt, homieBase+"/$homie", homieVersion)
+	publishRetained(mqtt, homieBase+"/$name", device.Name)
+	publishRetained(mqtt, homieBase+"/$extensions", "")
+
+	nodeProperties := make(map[homieNode][]string)
+	for _, property := range homieProperties {
+		nodeProperties[property.node] = append(nodeProperties[property.node], property.id)
+
+		topic := property.topic()
+		publishRetained(mqtt, topic+"/$name", property.name)
+		publishRetained(mqtt, topic+"/$datatype", property.datatype)
+		publishRetained(mqtt, topic+"/$settable", fmt.Sprint(property.settable))
+		if property.unit != "" {
+			publishRetained(mqtt, topic+"/$unit", property.unit)
+		}
+		if property.format != "" {
+			publishRetained(mqtt, topic+"/$format", property.format)
+		}
+	}
+
+	var nodes []string
+	for _, node := range homieNodes {
+		properties := nodeProperties[node]
+		if len(properties) == 0 {
+			continue
+		}
+		sort.Strings(properties)
+		nodes = append(nodes, node.id)
+		topic := fmt.Sprintf("%s/%s", homieBase, node.id)
+		publishRetained(mqtt, topic+"/$name", node.name)
+		publishRetained(mqtt, topic+"/$type", "ventilation")
+		publishRetained(mqtt, topic+"/$properties", strings.Join(properties, ","))
+	}
+	publishRetained(mqtt, homieBase+"/$nodes", strings.Join(nodes, ","))
+
+	publishRetained(mqtt, homieBase+"/$state", "ready")
+}
+
+// disconnectHomie publishes disconnected state before a graceful disconnect, the will
+// publishes lost only when the connection is lost
+func disconnectHomie(mqtt publisher) {
+	t := mqtt.Publish(homieBase+"/$state", 1, true, "disconnected")
+	if !t.WaitTimeout(time.Second) {
+		logError.Printf("publishing homie disconnected state timed out")
+	} else if t.Error() != nil {
+		logError.Printf("publishing homie disconnected state failed %v", t.Error())
+	}
+}
+
+// publishHomieValue publishes value of a vallox topic to its homie property
+func publishHomieValue(mqtt publisher, topic string, value string) {
+	if property, ok := homieProperties[topic]; ok {
+		publishRetained(mqtt, property.topic(), value)
+	}
+}
+
+func (g *Gateway) subscribeHomie(mqtt mqttClient.Client) {
+	for _, e := range registry {
+		if e.set != nil {
+			mqtt.Subscribe(homieProperties[e.topic].topic()+"/set", 0, g.handler(e.set))
+		}
+	}
+}
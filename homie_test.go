@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestHomieID(t *testing.T) {
+	tests := []struct {
+		level string
+		id    string
+	}{
+		{"outdoor", "outdoor"},
+		{"exhaustIn", "exhaust-in"},
+		{"CO2Alarm", "co2-alarm"},
+		{"sensor1", "sensor1"},
+		{"raw", "raw"},
+	}
+	for _, test := range tests {
+		if id := homieID(test.level); id != test.id {
+			t.Errorf("%s: expected %s, got %s", test.level, test.id, id)
+		}
+	}
+}
+
+func TestHomieProperties(t *testing.T) {
+	ids := make(map[string]string)
+	for _, e := range registry {
+		property, ok := homieProperties[e.topic]
+		if !ok {
+			t.Errorf("expected homie property for %s", e.topic)
+			continue
+		}
+		if boolean := property.datatype == "boolean"; boolean != (e.flag != 0) {
+			t.Errorf("%s: unexpected datatype %s", e.topic, property.datatype)
+		}
+		if other, ok := ids[property.topic()]; ok && other != e.topic {
+			t.Errorf("%s and %s have the same homie topic %s", e.topic, other, property.topic())
+		}
+		ids[property.topic()] = e.topic
+	}
+
+	tests := []struct {
+		topic    string
+		expected homieProperty
+	}{
+		{topicTempOutdoor, homieProperty{node: homieNodeTemperatures, id: "outdoor", name: "Ulkolämpötila", datatype: "integer", unit: "°C"}},
+		{topicFanCurrentSpeed, homieProperty{node: homieNodeFan, id: "current-speed", name: "Nykyinen puhallinnopeus", datatype: "integer", format: "1:8", settable: true}},
+		{topicFaultOutdoorSensor, homieProperty{node: homieNodeFaults, id: "outdoor-sensor", name: "Ulkoilma-anturivika", datatype: "boolean"}},
+		{topicIO8SummerMode, homieProperty{node: homieNodeFlags, id: "io8-summer-mode", name: "Peltimoottorin asento (kesä)", datatype: "boolean"}},
+	}
+	for _, test := range tests {
+		if property := homieProperties[test.topic]; property != test.expected {
+			t.Errorf("%s: expected %+v, got %+v", test.topic, test.expected, property)
+		}
+	}
+}
+
+func TestAnnounceHomie(t *testing.T) {
+	mqtt := &testPublisher{}
+	announceHomie(mqtt)
+
+	for _, msg := range mqtt.messages {
+		if !msg.retained {
+			t.Errorf("expected %s to be retained", msg.topic)
+		}
+	}
+
+	// $properties of nodes list the properties built from the registry
+	expected := make(map[string][]string)
+	for _, property := range homieProperties {
+		expected[property.node.id] = append(expected[property.node.id], property.id)
+	}
+	var nodes []string
+	for _, node := range homieNodes {
+		if len(expected[node.id]) == 0 {
+			continue
+		}
+		nodes = append(nodes, node.id)
+		sort.Strings(expected[node.id])
+		payloads := mqtt.payloads(homieBase + "/" + node.id + "/$properties")
+		if len(payloads) != 1 || payloads[0] != strings.Join(expected[node.id], ",") {
+			t.Errorf("%s: expected properties %v, got %v", node.id, expected[node.id], payloads)
+		}
+	}
+	if payloads := mqtt.payloads(homieBase + "/$nodes"); len(payloads) != 1 || payloads[0] != strings.Join(nodes, ",") {
+		t.Errorf("expected nodes %v, got %v", nodes, payloads)
+	}
+
+	for _, property := range homieProperties {
+		if payloads := mqtt.payloads(property.topic() + "/$datatype"); len(payloads) != 1 || payloads[0] != property.datatype {
+			t.Errorf("%s: expected datatype %s, got %v", property.topic(), property.datatype, payloads)
+		}
+	}
+
+	// state is init while attributes are published
+	states := mqtt.payloads(homieBase + "/$state")
+	if strings.Join(states, ",") != "init,ready" {
+		t.Errorf("expected state init and ready, got %v", states)
+	}
+	if first, last := mqtt.messages[0], mqtt.messages[len(mqtt.messages)-1]; first.payload != "init" || last.payload != "ready" {
+		t.Errorf("expected init first and ready last, got %+v and %+v", first, last)
+	}
+
+	disconnectHomie(mqtt)
+	if states := mqtt.payloads(homieBase + "/$state"); strings.Join(states, ",") != "init,ready,disconnected" {
+		t.Errorf("expected disconnected state on disconnect, got %v", states)
+	}
+}
+
+func TestPublishHomieValue(t *testing.T) {
+	mqtt := &testPublisher{}
+	publishHomieValue(mqtt, topicTempOutdoor, "-5")
+	publishHomieValue(mqtt, "vallox/unknown", "1")
+
+	if len(mqtt.messages) != 1 {
+		t.Fatalf("expected only registry values to be published, got %+v", mqtt.messages)
+	}
+	if msg := mqtt.messages[0]; msg.topic != homieBase+"/temperatures/outdoor" || msg.payload != "-5" || !msg.retained {
+		t.Errorf("unexpected homie value %+v", msg)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+const (
+	// Maximum number of lines kept while the target is unavailable, oldest are dropped first
+	influxMaxPending = 10000
+
+	// dropped events are logged at most once per interval
+	influxDropLogInterval = time.Minute
+)
+
+// influxWriter writes a batch of line protocol lines to the target, returning the number
+// of lines written before an error so they are not written again
+type influxWriter interface {
+	write(lines []string) (int, error)
+}
+
+type influxHttpWriter struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+type influxUdpWriter struct {
+	address string
+}
+
+type influxFileWriter struct {
+	path string
+}
+
+// influxOutput queues events of one gateway to be written by run
+type influxOutput struct {
+	writer        influxWriter
+	measurement   string
+	deviceId      string
+	batchSize     int
+	flushInterval time.Duration
+	lines         chan string
+
+	dropped       int       // events dropped since the latest log
+	droppedLogged time.Time // time of the latest log of dropped events
+}
+
+// newInflux creates output to influxdb target configured by INFLUX_URL
+func newInflux(c Config) *influxOutput {
+	writer, err := newInfluxWriter(c)
+	if err != nil {
+		logError.Fatalf("invalid influx url %s: %v", c.InfluxUrl, err)
+	}
+
+	logInfo.Printf("writing events to influx %s", c.InfluxUrl)
+
+	return &influxOutput{
+		writer:        writer,
+		measurement:   c.InfluxMeasurement,
+		deviceId:      c.InfluxDeviceId,
+		batchSize:     c.InfluxBatchSize,
+		flushInterval: c.InfluxFlushInterval,
+		lines:         make(chan string, c.InfluxBatchSize),
+	}
+}
+
+// run writes queued lines to influx
+func (o *influxOutput) run() {
+	runInflux(o.writer, o.lines, o.batchSize, o.flushInterval)
+}
+
+func newInfluxWriter(c Config) (influxWriter, error) {
+	u, err := url.Parse(c.InfluxUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		query := url.Values{}
+		query.Set("org", c.InfluxOrg)
+		query.Set("bucket", c.InfluxBucket)
+		query.Set("precision", "ns")
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		u.RawQuery = query.Encode()
+		return &influxHttpWriter{url: u.String(), token: c.InfluxToken, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	case "udp":
+		return &influxUdpWriter{address: u.Host}, nil
+	case "file":
+		return &influxFileWriter{path: u.Path}, nil
+	default:
+		return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+}
+
+// influxResult is the outcome of writing a batch
+type influxResult struct {
+	written int
+	err     error
+}
+
+// runInflux batches lines and flushes them when batch is full or flush interval has passed,
+// failed batches are retried on next flush interval.  Batches are written by a separate
+// goroutine, so lines are queued while a write is in flight.
+func runInflux(writer influxWriter, lines chan string, batchSize int, flushInterval time.Duration) {
+	var pending []string // lines waiting for the next write
+	var writing []string // lines being written, nil when no write is in flight
+	retrying := false
+	results := make(chan influxResult)
+	ticker := time.NewTicker(flushInterval)
+
+	flush := func() {
+		if writing != nil || len(pending) == 0 {
+			return
+		}
+		writing, pending = pending, nil
+		go func(batch []string) {
+			written, err := writer.write(batch)
+			results <- influxResult{written: written, err: err}
+		}(writing)
+	}
+
+	for {
+		select {
+		case line := <-lines:
+			pending = append(pending, line)
+			if len(pending) >= batchSize && !retrying {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case result := <-results:
+			if result.err != nil {
+				logError.Printf("writing %d lines to influx failed, retrying later: %v", len(writing)-result.written, result.err)
+				pending = append(writing[result.written:], pending...)
+				if len(pending) > influxMaxPending {
+					pending = pending[len(pending)-influxMaxPending:]
+				}
+				retrying = true
+				writing = nil
+			} else {
+				retrying = false
+				writing = nil
+				// lines received during the write may fill the next batch
+				if len(pending) >= batchSize {
+					flush()
+				}
+			}
+		}
+	}
+}
+
+// write queues the event to be written to influx
+func (o *influxOutput) write(event vallox.Event, t time.Time) {
+	line := influxLine(o.measurement, o.deviceId, event, t)
+	select {
+	case o.lines <- line:
+	default:
+		o.dropped++
+		if t.Sub(o.droppedLogged) >= influxDropLogInterval {
+			logError.Printf("influx queue full, dropped %d events", o.dropped)
+			o.dropped = 0
+			o.droppedLogged = t
+		}
+	}
+}
+
+// influxLine formats the event as line protocol with decoded values and raw value as fields
+func influxLine(measurement string, deviceId string, event vallox.Event, t time.Time) string {
+	fields := []string{fmt.Sprintf("raw=%di", event.RawValue)}
+	for topic, value := range eventValues(event) {
+		key := strings.ReplaceAll(strings.TrimPrefix(topic, "vallox/"), "/", "_")
+		fields = append(fields, fmt.Sprintf("%s=%s", influxEscape(key), influxFieldValue(value)))
+	}
+	sort.Strings(fields)
+
+	return fmt.Sprintf("%s,device=%s,register=%x %s %d",
+		influxEscape(measurement), influxEscape(deviceId), event.Register, strings.Join(fields, ","), t.UnixNano())
+}
+
+func influxFieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		return fmt.Sprint(v)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%di", v)
+	case float32, float64:
+		return fmt.Sprint(v)
+	default:
+		return fmt.Sprintf("%q", fmt.Sprint(v))
+	}
+}
+
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+func influxEscape(s string) string {
+	return influxEscaper.Replace(s)
+}
+
+func (w *influxHttpWriter) write(lines []string) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return len(lines), nil
+}
+
+func (w *influxUdpWriter) write(lines []string) (int, error) {
+	conn, err := net.Dial("udp", w.address)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// One datagram per line to stay below packet size limits
+	for i, line := range lines {
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			return i, err
+		}
+	}
+	return len(lines), nil
+}
+
+func (w *influxFileWriter) write(lines []string) (int, error) {
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	data := strings.Join(lines, "\n") + "\n"
+	n, err := f.WriteString(data)
+	// only complete lines were written
+	return strings.Count(data[:n], "\n"), err
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+func TestInfluxLine(t *testing.T) {
+	e := vallox.Event{Register: vallox.RegisterOutdoorTemp, RawValue: 100, Value: int16(-3)}
+	at := time.Unix(1700000000, 5)
+
+	line := influxLine("vallox air,x=1", "home unit", e, at)
+	expected := fmt.Sprintf(`vallox\ air\,x\=1,device=home\ unit,register=%x raw=100i,temp_outdoor=-3i 1700000000000000005`, vallox.RegisterOutdoorTemp)
+	if line != expected {
+		t.Errorf("expected %s, got %s", expected, line)
+	}
+}
+
+func TestInfluxFieldValue(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected string
+	}{
+		{true, "true"},
+		{int16(-3), "-3i"},
+		{byte(200), "200i"},
+		{1.5, "1.5"},
+		{`say "hi"`, `"say \"hi\""`},
+	}
+	for _, test := range tests {
+		if got := influxFieldValue(test.value); got != test.expected {
+			t.Errorf("%v: expected %s, got %s", test.value, test.expected, got)
+		}
+	}
+}
+
+// influxTestServer records bodies of write requests
+type influxTestServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []string
+}
+
+func startInfluxTestServer(t *testing.T) *influxTestServer {
+	s := &influxTestServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, string(body))
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// waitBodies waits until count write requests have been received
+func (s *influxTestServer) waitBodies(t *testing.T, count int) []string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mu.Lock()
+		bodies := append([]string(nil), s.bodies...)
+		s.mu.Unlock()
+		if len(bodies) >= count {
+			return bodies
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d writes, got %v", count, bodies)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestInfluxHttpWrite(t *testing.T) {
+	server := startInfluxTestServer(t)
+	writer, err := newInfluxWriter(Config{InfluxUrl: server.URL, InfluxOrg: "home", InfluxBucket: "air", InfluxToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan string, 10)
+	go runInflux(writer, lines, 2, time.Hour)
+	lines <- "a"
+	lines <- "b"
+	lines <- "c"
+
+	if bodies := server.waitBodies(t, 1); bodies[0] != "a\nb" {
+		t.Errorf("expected full batch to be written, got %q", bodies[0])
+	}
+	request := server.requests[0]
+	if request.URL.Path != "/api/v2/write" || request.URL.Query().Get("org") != "home" ||
+		request.URL.Query().Get("bucket") != "air" || request.URL.Query().Get("precision") != "ns" {
+		t.Errorf("unexpected write url %s", request.URL)
+	}
+	if auth := request.Header.Get("Authorization"); auth != "Token secret" {
+		t.Errorf("expected token authorization, got %s", auth)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if bodies := server.waitBodies(t, 1); len(bodies) != 1 {
+		t.Errorf("expected partial batch to wait for flush interval, got %q", bodies)
+	}
+}
+
+func TestInfluxFlushInterval(t *testing.T) {
+	server := startInfluxTestServer(t)
+	writer, err := newInfluxWriter(Config{InfluxUrl: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan string, 10)
+	go runInflux(writer, lines, 100, 20*time.Millisecond)
+	lines <- "a"
+
+	if bodies := server.waitBodies(t, 1); bodies[0] != "a" {
+		t.Errorf("expected line to be flushed on interval, got %q", bodies[0])
+	}
+}
+
+// failingWriter fails the first writes after writing some lines and records the batches
+type failingWriter struct {
+	mu       sync.Mutex
+	failures int
+	written  int // lines written by a failing write
+	batches  []string
+}
+
+func (w *failingWriter) write(lines []string) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.batches = append(w.batches, strings.Join(lines, ","))
+	if len(w.batches) <= w.failures {
+		return w.written, fmt.Errorf("unavailable")
+	}
+	return len(lines), nil
+}
+
+// waitBatches waits until count batches have been written
+func (w *failingWriter) waitBatches(t *testing.T, count int) []string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		w.mu.Lock()
+		batches := append([]string(nil), w.batches...)
+		w.mu.Unlock()
+		if len(batches) >= count {
+			return batches
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d batches, got %q", count, batches)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestInfluxRetry(t *testing.T) {
+	writer := &failingWriter{failures: 1}
+	lines := make(chan string, 10)
+	go runInflux(writer, lines, 1, 50*time.Millisecond)
+	lines <- "a"
+	lines <- "b" // queued while retrying, not written on every line
+
+	if batches := writer.waitBatches(t, 2); batches[0] != "a" || batches[1] != "a,b" {
+		t.Errorf("expected failed batch to be retried with the next line, got %q", batches)
+	}
+}
+
+func TestInfluxRetryUnwritten(t *testing.T) {
+	writer := &failingWriter{failures: 1, written: 2}
+	lines := make(chan string, 10)
+	go runInflux(writer, lines, 3, 50*time.Millisecond)
+	lines <- "a"
+	lines <- "b"
+	lines <- "c"
+
+	if batches := writer.waitBatches(t, 2); batches[0] != "a,b,c" || batches[1] != "c" {
+		t.Errorf("expected only lines not written to be retried, got %q", batches)
+	}
+}
+
+// blockingWriter blocks writes until released
+type blockingWriter struct {
+	failingWriter
+	release chan bool
+}
+
+func (w *blockingWriter) write(lines []string) (int, error) {
+	<-w.release
+	return w.failingWriter.write(lines)
+}
+
+func TestInfluxQueueWhileWriting(t *testing.T) {
+	writer := &blockingWriter{release: make(chan bool)}
+	lines := make(chan string)
+	go runInflux(writer, lines, 1, time.Hour)
+
+	// lines are received while the first batch is being written
+	for _, line := range []string{"a", "b", "c"} {
+		select {
+		case lines <- line:
+		case <-time.After(time.Second):
+			t.Fatalf("expected line %s to be received while writing", line)
+		}
+	}
+
+	writer.release <- true
+	writer.release <- true
+	if batches := writer.waitBatches(t, 2); batches[0] != "a" || batches[1] != "b,c" {
+		t.Errorf("expected lines received while writing in the next batch, got %q", batches)
+	}
+}
+
+func TestInfluxDropLog(t *testing.T) {
+	var logged bytes.Buffer
+	saved := logError.Writer()
+	logError.SetOutput(&logged)
+	t.Cleanup(func() { logError.SetOutput(saved) })
+
+	o := &influxOutput{lines: make(chan string)} // nothing reads the queue
+	start := time.Now()
+	e := vallox.Event{Register: vallox.RegisterOutdoorTemp, RawValue: 100, Value: int16(5)}
+	for _, offset := range []time.Duration{0, time.Second, 2 * time.Second, influxDropLogInterval} {
+		o.write(e, start.Add(offset))
+	}
+
+	if lines := strings.Split(strings.TrimSpace(logged.String()), "\n"); len(lines) != 2 || !strings.HasSuffix(lines[1], "dropped 3 events") {
+		t.Errorf("expected dropped events to be logged once per interval, got %q", lines)
+	}
+}
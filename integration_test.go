@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	mqttClient "github.com/eclipse/paho.mqtt.golang"
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+// TestGatewayIntegration runs the gateway against in-process broker and fake device
+func TestGatewayIntegration(t *testing.T) {
+	broker := startTestBroker(t)
+	defer broker.close()
+
+	c := Config{MqttUrl: broker.url, MqttClientId: "vallox-test"}
+
+	bus := &testBus{events: make(chan vallox.Event)}
+	gateway := newGateway(c, newPersistentState(), bus)
+
+	mqtt := gateway.connectMqtt(c)
+	defer mqtt.Disconnect(0)
+	gateway.mqtt = mqtt
+
+	received := &testPublisher{}
+	observer := mqttClient.NewClient(mqttClient.NewClientOptions().AddBroker(broker.url).SetClientID("observer"))
+	if token := observer.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatalf("cannot connect observer: %v", token.Error())
+	}
+	defer observer.Disconnect(0)
+	token := observer.Subscribe("#", 0, func(client mqttClient.Client, msg mqttClient.Message) {
+		received.record(testMessage{topic: msg.Topic(), retained: msg.Retained(), payload: string(msg.Payload())})
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatalf("cannot subscribe observer: %v", token.Error())
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		gateway.run(stop)
+		close(stopped)
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	broker.waitSubscribed(t, "homeassistant/status")
+	broker.waitSubscribed(t, topicFanCurrentSpeed+"/set")
+
+	t.Run("discovery after home assistant online", func(t *testing.T) {
+		observer.Publish("homeassistant/status", 0, false, "online")
+		for component, entries := range gateway.discovery {
+			for _, entry := range entries {
+				received.waitFor(t, fmt.Sprintf("homeassistant/%s/%s/config", component, entry.UniqueId), 1)
+			}
+		}
+	})
+
+	outdoor := vallox.Event{Source: 0x11, Destination: testAddress, Register: vallox.RegisterOutdoorTemp, RawValue: 100, Value: int16(-3)}
+
+	t.Run("value publishing", func(t *testing.T) {
+		bus.events <- outdoor
+		if payloads := received.waitFor(t, topicTempOutdoor, 1); payloads[0] != "-3" {
+			t.Errorf("expected outdoor temperature -3, got %s", payloads[0])
+		}
+	})
+
+	t.Run("dedup within 15 minutes", func(t *testing.T) {
+		bus.events <- outdoor
+		// events are handled in order, so the duplicate has been handled when the next value arrives
+		bus.events <- vallox.Event{Source: 0x11, Destination: testAddress, Register: vallox.RegisterSupplyTemp, RawValue: 150, Value: int16(18)}
+		received.waitFor(t, topicTempSupply, 1)
+		if payloads := received.payloads(topicTempOutdoor); len(payloads) != 1 {
+			t.Errorf("expected duplicate not to be published, got %v", payloads)
+		}
+	})
+
+	t.Run("speed command written to bus", func(t *testing.T) {
+		observer.Publish(topicFanCurrentSpeed+"/set", 0, false, "3")
+		deadline := time.Now().Add(10 * time.Second)
+		for len(bus.sentSpeeds()) == 0 && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if speeds := bus.sentSpeeds(); len(speeds) != 1 || speeds[0] != 3 {
+			t.Errorf("expected speed 3 to be written to bus, got %v", speeds)
+		}
+	})
+}
@@ -6,7 +6,10 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	vallox "github.com/jokujossai/vallox-rs485"
@@ -51,6 +54,7 @@ const (
 	topicCO2Sensor3   = "vallox/co2/installed/sensor3"
 	topicCO2Sensor4   = "vallox/co2/installed/sensor4"
 	topicCO2Sensor5   = "vallox/co2/installed/sensor5"
+	topicCO2Ppm       = "vallox/co2/ppm"
 
 	topicMessage = "vallox/message/value"
 
@@ -67,9 +71,8 @@ const (
 	topicFaultWaterCoilFreezing = "vallox/fault/waterCoilFreezing"
 	topicFaultExhaustOutSensor  = "vallox/fault/exhaustOutSensor"
 
-	topicPostHeatingOnTime     = "vallox/postHeating/onTime"
-	topicPostHeatingOffTime    = "vallox/postHeating/offTime"
-	topicPostHeatingTargetTemp = "vallox/postHeating/targetTemp"
+	topicPostHeatingOnTime  = "vallox/postHeating/onTime"
+	topicPostHeatingOffTime = "vallox/postHeating/offTime"
 
 	topicFlags2Raw                 = "vallox/flags2/raw"
 	topicFlags2CO2HigherSpeedReq   = "vallox/flags2/CO2HigherSpeedReq"
@@ -123,670 +126,161 @@ const (
 
 	topicCO2ControlSetpointUpper = "vallox/co2/controlSetpoint/upper"
 	topicCO2ControlSetpointLower = "vallox/co2/controlSetpoint/lower"
+	topicCO2ControlSetpointPpm   = "vallox/co2/controlSetpoint/ppm"
 
 	topicProgram2Raw      = "vallox/program2/raw"
 	topicProgram2MaxSpeed = "vallox/program2/maxSpeed"
+
+	topicState = "vallox/state"
 )
 
-var topicMap = map[byte]string{
-	vallox.RegisterIO07:                 topicIO7Raw,
-	vallox.RegisterIO08:                 topicIO8Raw,
-	vallox.RegisterCurrentFanSpeed:      topicFanCurrentSpeed,
-	vallox.RegisterMaxRH:                topicRHMax,
-	vallox.RegisterCurrentCO2:           topicCO2Current,
-	vallox.RegisterMaximumCO2:           topicCO2Max,
-	vallox.RegisterCO2Status:            topicCO2SensorRaw,
-	vallox.RegisterMessage:              topicMessage,
-	vallox.RegisterRH1:                  topicRH1,
-	vallox.RegisterRH2:                  topicRH2,
-	vallox.RegisterOutdoorTemp:          topicTempOutdoor,
-	vallox.RegisterExhaustOutTemp:       topicTempExhaustOut,
-	vallox.RegisterExhaustInTemp:        topicTempExhaustIn,
-	vallox.RegisterSupplyTemp:           topicTempSupply,
-	vallox.RegisterFaultCode:            topicFaultRaw,
-	vallox.RegisterPostHeatingOnTime:    topicPostHeatingOnTime,
-	vallox.RegisterPostHeatingOffTime:   topicPostHeatingOffTime,
-	vallox.RegisterFlags02:              topicFlags2Raw,
-	vallox.RegisterFlags04:              topicFlags4Raw,
-	vallox.RegisterFlags05:              topicFlags5Raw,
-	vallox.RegisterFlags06:              topicFlags6Raw,
-	vallox.RegisterFireplaceCounter:     topicFireplaceSwitchCounter,
-	vallox.RegisterStatus:               topicStatusRaw,
-	vallox.RegisterPostHeatingSetpoint:  topicPostHeatingSetpoint,
-	vallox.RegisterMaxFanSpeed:          topicFanMaxSpeed,
-	vallox.RegisterServiceInterval:      topicServiceReminderInterval,
-	vallox.RegisterPreheatingTemp:       topicPreHeatingSwitching,
-	vallox.RegisterSupplyFanStopTemp:    topicSupplyFanStop,
-	vallox.RegisterDefaultFanSpeed:      topicFanDefaultSpeed,
-	vallox.RegisterProgram:              topicProgramRaw,
-	vallox.RegisterServiceCounter:       topicServiceReminderCounter,
-	vallox.RegisterBasicHumidity:        topicRHBasic,
-	vallox.RegisterBypassTemp:           topicBypassOperating,
-	vallox.RegisterSupplyFanSetpoint:    topicSupplyFanControlSetpoint,
-	vallox.RegisterExhaustFanSetpoint:   topicExhaustFanControlSetpoint,
-	vallox.RegisterAntiFreezeHysteresis: topicCellAntifreezeHysteresis,
-	vallox.RegisterCO2SetpointUpper:     topicCO2ControlSetpointUpper,
-	vallox.RegisterCO2SetpointLower:     topicCO2ControlSetpointLower,
-	vallox.RegisterProgram2:             topicProgram2Raw,
-}
+// stateDebounce is how long to wait for further changes before publishing the aggregate state,
+// stateMaxDelay is the longest a change waits while values keep changing
+const (
+	stateDebounce = 2 * time.Second
+	stateMaxDelay = 10 * time.Second
+)
 
-var topicFlagMap = map[byte]map[byte]string{
-	vallox.RegisterIO07: map[byte]string{
-		vallox.IO07FlagReheating: topicIO7Reheating,
-	},
-	vallox.RegisterIO08: map[byte]string{
-		vallox.IO08FlagSummerMode:      topicIO8SummerMode,
-		vallox.IO08FlagErrorRelay:      topicIO8ErrorRelay,
-		vallox.IO08FlagMotorIn:         topicIO8MotorIn,
-		vallox.IO08FlagPreheating:      topicIO8Preheating,
-		vallox.IO08FlagMotorOut:        topicIO8MotorOut,
-		vallox.IO08FlagFireplaceSwitch: topicIO8FireplaceSwitch,
-	},
-	vallox.RegisterCO2Status: map[byte]string{
-		vallox.CO2Sensor1: topicCO2Sensor1,
-		vallox.CO2Sensor2: topicCO2Sensor2,
-		vallox.CO2Sensor3: topicCO2Sensor3,
-		vallox.CO2Sensor4: topicCO2Sensor4,
-	},
-	vallox.RegisterFaultCode: map[byte]string{
-		vallox.FaultSupplyAirSensorFault:     topicFaultSupplySensor,
-		vallox.FaultCarbonDioxideAlarm:       topicFaultCO2Alarm,
-		vallox.FaultOutdoorSensorFault:       topicFaultOutdoorSensor,
-		vallox.FaultExhaustAirInSensorFault:  topicFaultExhaustInSensor,
-		vallox.FaultWaterCoilFreezing:        topicFaultWaterCoilFreezing,
-		vallox.FaultExhaustAirOutSensorFault: topicFaultExhaustOutSensor,
-	},
-	vallox.RegisterFlags02: map[byte]string{
-		vallox.Flags2CO2HigherSpeedReq:   topicFlags2CO2HigherSpeedReq,
-		vallox.Flags2CO2LowerSpeedReq:    topicFlags2CO2LowerSpeedReq,
-		vallox.Flags2RHLowerSpeedReq:     topicFlags2RHLowerSpeedReq,
-		vallox.Flags2SwitchLowerSpeedReq: topicFlags2SwitchLowerSpeedReq,
-		vallox.Flags2CO2Alarm:            topicFlags2CO2Alarm,
-		vallox.Flags2CellFreezeAlarm:     topicFlags2CellFreezeAlarm,
-	},
-	vallox.RegisterFlags04: map[byte]string{
-		vallox.Flags4WaterCoilFreezing: topicFlags4WaterCoilFreezing,
-		vallox.Flags4Master:            topicFlags4Master,
-	},
-	vallox.RegisterFlags05: map[byte]string{
-		vallox.Flags5PreheatingStatus: topicFlags5PreheatingStatus,
-	},
-	vallox.RegisterFlags06: map[byte]string{
-		vallox.Flags6RemoteControl:           topicFlags6RemoteControl,
-		vallox.Flags6ActivateFireplaceSwitch: topicFlags6FireplaceSwitch,
-		vallox.Flags6FireplaceFunction:       topicFlags6FireplaceFuncion,
-	},
-	vallox.RegisterStatus: map[byte]string{
-		vallox.StatusFlagPower:       topicStatusPower,
-		vallox.StatusFlagCO2:         topicStatusCO2,
-		vallox.StatusFlagRH:          topicStatusRH,
-		vallox.StatusFlagHeatingMode: topicStatusPostHeatingKey,
-		vallox.StatusFlagFilter:      topicStatusFilterGuard,
-		vallox.StatusFlagHeating:     topicStatusPostHeatingLed,
-		vallox.StatusFlagFault:       topicStatusFault,
-		vallox.StatusFlagService:     topicStatusService,
-	},
-	vallox.RegisterProgram: map[byte]string{
-		vallox.ProgramFlagAutomaticHumidity: topicProgramAutomaticHumidity,
-		vallox.ProgramFlagBoostSwitch:       topicProgramFireplaceSwitch,
-		vallox.ProgramFlagWater:             topicProgramWater,
-		vallox.ProgramFlagCascadeControl:    topicProgramCascadeControl,
-	},
-	vallox.RegisterProgram2: map[byte]string{
-		vallox.Program2FlagMaximumSpeedLimit: topicProgram2MaxSpeed,
-	},
+// stateDelay returns how long to wait before publishing the aggregate state changed first at first
+func stateDelay(first time.Time, now time.Time) time.Duration {
+	delay := stateDebounce
+	if remaining := stateMaxDelay - now.Sub(first); remaining < delay {
+		delay = remaining
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
 }
 
 // TODO: Configurable
-var device = map[string]interface{}{
-	"identifiers": []string{
-		"vallox",
-	},
-	"manufacturer": "Vallox",
-	"name":         "Vallox Digit SE",
-	"model":        "Digit SE",
+// haDevice is the device entities belong to in Home Assistant
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Manufacturer string   `json:"manufacturer"`
+	Name         string   `json:"name"`
+	Model        string   `json:"model"`
+}
+
+// haEntity is discovery config of a Home Assistant entity
+type haEntity struct {
+	UniqueId          string   `json:"unique_id"`
+	Name              string   `json:"name"`
+	Device            haDevice `json:"device"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	EntityCategory    string   `json:"entity_category,omitempty"`
+	Icon              string   `json:"icon,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	StateTopic        string   `json:"state_topic,omitempty"`
+	CommandTopic      string   `json:"command_topic,omitempty"`
+	AvailabilityTopic string   `json:"availability_topic,omitempty"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	PayloadOn         string   `json:"payload_on,omitempty"`
+	PayloadOff        string   `json:"payload_off,omitempty"`
+	StateOn           string   `json:"state_on,omitempty"`
+	StateOff          string   `json:"state_off,omitempty"`
+	*haRange
+}
+
+// haRange is value range of number entities
+type haRange struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Step float64 `json:"step,omitempty"`
+	Mode string  `json:"mode,omitempty"`
 }
 
-var discovery = map[string][]map[string]interface{}{
+var device = haDevice{
+	Identifiers:  []string{"vallox"},
+	Manufacturer: "Vallox",
+	Name:         "Vallox Digit SE",
+	Model:        "Digit SE",
+}
+
+// baseDiscovery contains Home Assistant entities by component, register values are added from
+// registry.  Gateway adds entities of enabled features to its own copy.
+var baseDiscovery = withRegistry(map[string][]haEntity{
 	"binary_sensor": {
-		map[string]interface{}{
-			"unique_id":    "vallox_io7_reheating",
-			"name":         "Jälkilämmitys",
-			"device":       device,
-			"device_class": "heat",
-			"state_topic":  topicIO7Reheating,
-			"payload_on":   "true",
-			"payload_off":  "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_io8_summer_mode",
-			"name":        "Peltimoottorin asento (kesä)",
-			"device":      device,
-			"state_topic": topicIO8SummerMode,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_io8_error_relay",
-			"name":        "Vikatietorele",
-			"device":      device,
-			"state_topic": topicIO8ErrorRelay,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_io8_flag_motor_in",
-			"name":        "Tulopuhallin",
-			"device":      device,
-			"state_topic": topicIO8MotorIn,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":    "vallox_io8_preheating",
-			"name":         "Etulämmitys",
-			"device":       device,
-			"device_class": "heat",
-			"state_topic":  topicIO8Preheating,
-			"payload_on":   "true",
-			"payload_off":  "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_io8_motor_out",
-			"name":        "Poistopuhallin",
-			"device":      device,
-			"state_topic": topicIO8MotorOut,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_io8_fireplace_switch",
-			"name":        "Takka/tehostuskytkin",
-			"device":      device,
-			"state_topic": topicIO8FireplaceSwitch,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":    "vallox_status_power",
-			"name":         "Virtanäppäin",
-			"device":       device,
-			"device_class": "plug",
-			"state_topic":  topicStatusPower,
-			"payload_on":   "true",
-			"payload_off":  "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_co2_status_1",
-			"name":        "CO2 anturi 1",
-			"device":      device,
-			"state_topic": topicCO2Sensor1,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_co2_status_2",
-			"name":        "CO2 anturi 2",
-			"device":      device,
-			"state_topic": topicCO2Sensor2,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_co2_status_3",
-			"name":        "CO2 anturi 3",
-			"device":      device,
-			"state_topic": topicCO2Sensor3,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_co2_status_4",
-			"name":        "CO2 anturi 4",
-			"device":      device,
-			"state_topic": topicCO2Sensor4,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":    "vallox_fault_supply_sensor",
-			"name":         "Tuloilma-anturivika",
-			"device":       device,
-			"device_class": "problem",
-			"state_topic":  topicFaultSupplySensor,
-			"payload_on":   "true",
-			"payload_off":  "false",
-		},
-		map[string]interface{}{
-			"unique_id":    "vallox_fault_co2_alarm",
-			"name":         "Hiilidioksidihälytys",
-			"device":       device,
-			"device_class": "problem",
-			"state_topic":  topicFaultCO2Alarm,
-			"payload_on":   "true",
-			"payload_off":  "false",
-		},
-		map[string]interface{}{
-			"unique_id":    "vallox_fault_outdoor_sensor",
-			"name":         "Ulkoilma-anturivika",
-			"device":       device,
-			"device_class": "problem",
-			"state_topic":  topicFaultOutdoorSensor,
-			"payload_on":   "true",
-			"payload_off":  "false",
-		},
-		map[string]interface{}{
-			"unique_id":    "vallox_fault_exhaust_in",
-			"name":         "Poistoilma-anturivika",
-			"device":       device,
-			"device_class": "problem",
-			"state_topic":  topicFaultExhaustInSensor,
-			"payload_on":   "true",
-			"payload_off":  "false",
-		},
-		map[string]interface{}{
-			"unique_id":    "vallox_fault_water_coil_freezing",
-			"name":         "Vesipatterin jäätymisvaara",
-			"device":       device,
-			"device_class": "problem",
-			"state_topic":  topicFaultWaterCoilFreezing,
-			"payload_on":   "true",
-			"payload_off":  "false",
-		},
-		map[string]interface{}{
-			"unique_id":    "vallox_fault_exhaust_out",
-			"name":         "Jäteilma-anturivika",
-			"device":       device,
-			"device_class": "problem",
-			"state_topic":  topicFaultExhaustOutSensor,
-			"payload_on":   "true",
-			"payload_off":  "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_flags2_co2_higher_speed_req",
-			"name":        "CO2 suurempi nopeus -pyyntö",
-			"device":      device,
-			"state_topic": topicFlags2CO2HigherSpeedReq,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_flags2_co2_lower_speed_req",
-			"name":        "CO2 pienempi nopeus -pyyntö",
-			"device":      device,
-			"state_topic": topicFlags2CO2LowerSpeedReq,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_flags2_rh_lower_speed_req",
-			"name":        "%RH pienempi nopeus -pyyntö",
-			"device":      device,
-			"state_topic": topicFlags2RHLowerSpeedReq,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_flags2_switch_lower_speed_req",
-			"name":        "Kytkin pien. nop. -pyyntö",
-			"device":      device,
-			"state_topic": topicFlags2SwitchLowerSpeedReq,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":    "vallox_flags2_co2_alarm",
-			"name":         "CO2 -hälytys",
-			"device":       device,
-			"device_class": "problem",
-			"state_topic":  topicFlags2CO2Alarm,
-			"payload_on":   "true",
-			"payload_off":  "false",
-		},
-		map[string]interface{}{
-			"unique_id":    "vallox_flags2_cell_freeze_alarm",
-			"name":         "Kennon jäätymishälytys",
-			"device":       device,
-			"device_class": "problem",
-			"state_topic":  topicFlags2CellFreezeAlarm,
-			"payload_on":   "true",
-			"payload_off":  "false",
-		},
-		map[string]interface{}{
-			"unique_id":    "vallox_flags4_water_coil_freezing_alert",
-			"name":         "Vesipatterin jäätymisvaara",
-			"device":       device,
-			"device_class": "problem",
-			"state_topic":  topicFlags4WaterCoilFreezing,
-			"payload_on":   "true",
-			"payload_off":  "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_flags4_master",
-			"name":        "slave(false)/master(true) valinta",
-			"device":      device,
-			"state_topic": topicFlags4Master,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_flags5_preheating_status",
-			"name":        "Etulämmityksen tilalippu",
-			"device":      device,
-			"state_topic": topicFlags5PreheatingStatus,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_flags6_remote_control",
-			"name":        "Kaukovalvontaohjaus",
-			"device":      device,
-			"state_topic": topicFlags6RemoteControl,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_flags6_fireplace_switch_activation",
-			"name":        "Takkakykimen aktivointi",
-			"device":      device,
-			"state_topic": topicFlags6FireplaceSwitch,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_flags6_fireplace_function_state",
-			"name":        "Takka/tehostustoiminto",
-			"device":      device,
-			"state_topic": topicFlags6FireplaceFuncion,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_status_power",
-			"name":        "Virtanäppäin",
-			"device":      device,
-			"state_topic": topicStatusPower,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_status_co2_key",
-			"name":        "CO2 -näppäin",
-			"device":      device,
-			"state_topic": topicStatusCO2,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_status_rh_key",
-			"name":        "%RH -näppäin",
-			"device":      device,
-			"state_topic": topicStatusRH,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_status_post_heating_key",
-			"name":        "Jälkilämmityksen näppäin",
-			"device":      device,
-			"state_topic": topicStatusPostHeatingKey,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_status_filter_guard_led",
-			"name":        "Suodatinvahdin merkkivalo",
-			"device":      device,
-			"state_topic": topicStatusFilterGuard,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_status_post_heating_led",
-			"name":        "Jälkilämmityksen merkkivalo",
-			"device":      device,
-			"state_topic": topicStatusPostHeatingLed,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_status_fault_led",
-			"name":        "Vian merkkivalo",
-			"device":      device,
-			"state_topic": topicStatusFault,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_status_service_reminder",
-			"name":        "Huoltomuistutin",
-			"device":      device,
-			"state_topic": topicStatusService,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_program_automatic_humidity",
-			"name":        "Kosteustason automaattihaku",
-			"device":      device,
-			"state_topic": topicProgramAutomaticHumidity,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_program_fireplace_switch",
-			"name":        "tehostus(on)/takkakytkimen(off) tila",
-			"device":      device,
-			"state_topic": topicProgramFireplaceSwitch,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_program_water",
-			"name":        "Vesi(on)/sähköpatterimalli(off)",
-			"device":      device,
-			"state_topic": topicProgramWater,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_program_cascade_control",
-			"name":        "Kaskadisäätö",
-			"device":      device,
-			"state_topic": topicProgramCascadeControl,
-			"payload_on":  "true",
-			"payload_off": "false",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_program2_max_speed",
-			"name":        "Maksiminopeuden rajoitus",
-			"device":      device,
-			"state_topic": topicProgram2MaxSpeed,
-			"payload_on":  "true",
-			"payload_off": "false",
+		haEntity{
+			UniqueId:    "vallox_service_due",
+			Name:        "Huolto erääntynyt",
+			Device:      device,
+			DeviceClass: "problem",
+			StateTopic:  topicServiceDue,
+			PayloadOn:   "true",
+			PayloadOff:  "false",
 		},
 	},
 	"sensor": {
-		map[string]interface{}{
-			"unique_id":           "vallox_rh_max",
-			"name":                "Nykyinen maksimi ilmankosteus",
-			"device":              device,
-			"device_class":        "humidity",
-			"state_topic":         topicRHMax,
-			"unit_of_measurement": "%",
-		},
-		// TODO: CO2 upper | lower
-		map[string]interface{}{
-			"unique_id":   "vallox_message",
-			"name":        "Milliampeeri-/jänniteviesti",
-			"device":      device,
-			"state_topic": topicMessage,
-		},
-		map[string]interface{}{
-			"unique_id":           "vallox_rh_1",
-			"name":                "%RH #1",
-			"device":              device,
-			"device_class":        "humidity",
-			"state_topic":         topicRH1,
-			"unit_of_measurement": "%",
-		},
-		map[string]interface{}{
-			"unique_id":           "vallox_rh_2",
-			"name":                "%RH #2",
-			"device":              device,
-			"device_class":        "humidity",
-			"state_topic":         topicRH2,
-			"unit_of_measurement": "%",
-		},
-		map[string]interface{}{
-			"unique_id":           "vallox_temp_outdoor",
-			"name":                "Ulkolämpötila",
-			"device":              device,
-			"device_class":        "temperature",
-			"state_topic":         topicTempOutdoor,
-			"unit_of_measurement": "°C",
-		},
-		map[string]interface{}{
-			"unique_id":           "vallox_temp_exhaust_out",
-			"name":                "Jäteilman lämpötila",
-			"device":              device,
-			"device_class":        "temperature",
-			"state_topic":         topicTempExhaustOut,
-			"unit_of_measurement": "°C",
-		},
-		map[string]interface{}{
-			"unique_id":           "vallox_temp_exhaust_in",
-			"name":                "Poistoilman lämpötila",
-			"device":              device,
-			"device_class":        "temperature",
-			"state_topic":         topicTempExhaustIn,
-			"unit_of_measurement": "°C",
-		},
-		map[string]interface{}{
-			"unique_id":           "vallox_temp_supply",
-			"name":                "Tuloilman lämpötila",
-			"device":              device,
-			"device_class":        "temperature",
-			"state_topic":         topicTempSupply,
-			"unit_of_measurement": "°C",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_post_heating_on_time",
-			"name":        "Jälilämmityksen ON-laskuri",
-			"device":      device,
-			"state_topic": topicPostHeatingOnTime,
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_post_heating_off_time",
-			"name":        "Jälkilämmityksen OFF-aika",
-			"device":      device,
-			"state_topic": topicPostHeatingOffTime,
-		},
-		map[string]interface{}{
-			"unique_id":           "vallox_post_heating_target_temp",
-			"name":                "Jäkilämmityksen kohdearvo",
-			"device":              device,
-			"state_topic":         topicPostHeatingTargetTemp,
-			"unit_of_measurement": "°C",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_fireplace_switch_counter",
-			"name":        "Takka/tehostuskytkimen laskuri",
-			"device":      device,
-			"state_topic": topicFireplaceSwitchCounter,
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_post_heating_set_point",
-			"name":        "Jälkilämmityksen asetusarvo",
-			"device":      device,
-			"state_topic": topicPostHeatingSetpoint,
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_max_fan_speed",
-			"name":        "Maksimipuhallinnopeus",
-			"device":      device,
-			"icon":        "mdi:fan",
-			"state_topic": topicFanMaxSpeed,
-		},
-		map[string]interface{}{
-			"unique_id":    "vallox_service_reminder_interval",
-			"name":         "Huoltomuistuttimen aikaväli",
-			"device":       device,
-			"device_class": "duration",
-			"state_topic":  topicServiceReminderInterval,
-		},
-		map[string]interface{}{
-			"unique_id":           "vallox_pre_heating_switching",
-			"name":                "Etulämmityksen kytkentälämpötila",
-			"device":              device,
-			"device_class":        "temperature",
-			"state_topic":         topicPreHeatingSwitching,
-			"unit_of_measurement": "°C",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_default_fan_speed",
-			"name":        "Peruspuhallinnopeus",
-			"device":      device,
-			"icon":        "mdi:fan",
-			"state_topic": topicFanDefaultSpeed,
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_service_reminder_counter",
-			"name":        "Huoltomuistuttimen kuukausilaskuri",
-			"device":      device,
-			"state_topic": topicServiceReminderCounter,
-		},
-		map[string]interface{}{
-			"unique_id":           "vallox_rh_base",
-			"name":                "Peruskosteustaso",
-			"device":              device,
-			"state_topic":         topicRHBasic,
-			"unit_of_measurement": "%",
-		},
-		map[string]interface{}{
-			"unique_id":           "vallox_cell_bypass_temp",
-			"name":                "Kennonohituksen toimintalämpötila",
-			"device":              device,
-			"device_class":        "temperature",
-			"state_topic":         topicBypassOperating,
-			"unit_of_measurement": "°C",
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_supply_fan_control_setpoint",
-			"name":        "Tasaviratuloilmapuhaltimen säädön asetusarvo",
-			"device":      device,
-			"state_topic": topicSupplyFanControlSetpoint,
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_exhaust_fan_control_setpoint",
-			"name":        "Tasavirtapoistoilmapuhaltimen säädön asetusarvo",
-			"device":      device,
-			"state_topic": topicExhaustFanControlSetpoint,
-		},
-		map[string]interface{}{
-			"unique_id":   "vallox_cell_antifreeze_hysteresis",
-			"name":        "Kennon jäätymiseneston lämpötilojen hystereesi",
-			"device":      device,
-			"state_topic": topicCellAntifreezeHysteresis,
-		},
-	},
-	"number": {
-		map[string]interface{}{
-			"unique_id":     "vallox_current_fan_speed",
-			"name":          "Nykyinen puhallinnopeus",
-			"device":        device,
-			"icon":          "mdi:fan",
-			"state_topic":   topicFanCurrentSpeed,
-			"command_topic": topicFanCurrentSpeed + "/set",
-			"min":           1,
-			"max":           8,
-			"mode":          "slider",
+		haEntity{
+			UniqueId:          "vallox_efficiency_supply",
+			Name:              "Tuloilman lämpötilahyötysuhde",
+			Device:            device,
+			Icon:              "mdi:heat-wave",
+			StateClass:        "measurement",
+			StateTopic:        topicEfficiencySupply,
+			AvailabilityTopic: topicEfficiencyAvailable,
+			UnitOfMeasurement: "%",
+		},
+		haEntity{
+			UniqueId:          "vallox_efficiency_exhaust",
+			Name:              "Poistoilman lämpötilahyötysuhde",
+			Device:            device,
+			Icon:              "mdi:heat-wave",
+			StateClass:        "measurement",
+			StateTopic:        topicEfficiencyExhaust,
+			AvailabilityTopic: topicEfficiencyAvailable,
+			UnitOfMeasurement: "%",
+		},
+		haEntity{
+			UniqueId:          "vallox_service_remaining_months",
+			Name:              "Huoltoon kuukausia",
+			Device:            device,
+			Icon:              "mdi:wrench-clock",
+			StateTopic:        topicServiceRemainingMonths,
+			UnitOfMeasurement: "kk",
+		},
+		haEntity{
+			UniqueId:          "vallox_service_remaining_days",
+			Name:              "Huoltoon päiviä",
+			Device:            device,
+			DeviceClass:       "duration",
+			StateTopic:        topicServiceRemainingDays,
+			UnitOfMeasurement: "d",
+		},
+		haEntity{
+			UniqueId:    "vallox_service_last_reset",
+			Name:        "Edellinen huolto",
+			Device:      device,
+			DeviceClass: "timestamp",
+			StateTopic:  topicServiceLastReset,
+		},
+		haEntity{
+			UniqueId:   "vallox_faults_active",
+			Name:       "Aktiiviset viat",
+			Device:     device,
+			Icon:       "mdi:alert",
+			StateTopic: topicFaultsActive,
+		},
+		haEntity{
+			UniqueId:   "vallox_faults_count",
+			Name:       "Aktiivisten vikojen määrä",
+			Device:     device,
+			Icon:       "mdi:alert-circle",
+			StateTopic: topicFaultsCount,
+		},
+		haEntity{
+			UniqueId:   "vallox_faults_last",
+			Name:       "Viimeisin vikatapahtuma",
+			Device:     device,
+			Icon:       "mdi:history",
+			StateTopic: topicFaultsLast,
 		},
 	},
-}
+})
 
 type Config struct {
-	SerialDevice string `envconfig:"serial_device" required:"true"`
+	SerialDevice string `envconfig:"serial_device"`
 	MqttUrl      string `envconfig:"mqtt_url" required:"true"`
 	MqttUser     string `envconfig:"mqtt_user"`
 	MqttPwd      string `envconfig:"mqtt_password"`
@@ -794,63 +288,386 @@ type Config struct {
 	Debug        bool   `envconfig:"debug" default:"false"`
 	EnableWrite  bool   `envconfig:"enable_write" default:"false"`
 	EnableRaw    bool   `envconfig:"enable_raw" default:"false"`
+	EnableState  bool   `envconfig:"enable_state" default:"false"`
+	EnableHomie  bool   `envconfig:"enable_homie" default:"false"`
+	EnableSniff  bool   `envconfig:"enable_sniff" default:"false"`
+	SniffPassive bool   `envconfig:"sniff_passive" default:"false"`
+
+	InfluxUrl           string        `envconfig:"influx_url"`
+	InfluxToken         string        `envconfig:"influx_token"`
+	InfluxOrg           string        `envconfig:"influx_org"`
+	InfluxBucket        string        `envconfig:"influx_bucket" default:"vallox"`
+	InfluxMeasurement   string        `envconfig:"influx_measurement" default:"vallox"`
+	InfluxDeviceId      string        `envconfig:"influx_device_id" default:"vallox"`
+	InfluxBatchSize     int           `envconfig:"influx_batch_size" default:"100"`
+	InfluxFlushInterval time.Duration `envconfig:"influx_flush_interval" default:"10s"`
+
+	HistoryDir                string        `envconfig:"history_dir"`
+	HistoryRawRetention       time.Duration `envconfig:"history_raw_retention" default:"168h"`
+	HistoryRetention          time.Duration `envconfig:"history_retention" default:"8760h"`
+	HistoryDownsampleInterval time.Duration `envconfig:"history_downsample_interval" default:"5m"`
+
+	EfficiencyMinSpread float64 `envconfig:"efficiency_min_spread" default:"5"`
+
+	StateFile       string        `envconfig:"state_file"`
+	Airflow         []float64     `envconfig:"airflow"`
+	PostHeaterPower float64       `envconfig:"post_heater_power"`
+	FanPower        []float64     `envconfig:"fan_power"`
+	FanPowerMax     float64       `envconfig:"fan_power_max"`
+	EnergyMaxGap    time.Duration `envconfig:"energy_max_gap" default:"5m"`
+
+	Schedule []string `envconfig:"schedule"`
+
+	BoostSpeed    byte          `envconfig:"boost_speed" default:"8"`
+	BoostDuration time.Duration `envconfig:"boost_duration" default:"30m"`
+
+	DemandCO2Topics     []string      `envconfig:"demand_co2_topics"`
+	DemandRHTopics      []string      `envconfig:"demand_rh_topics"`
+	DemandCO2Levels     []string      `envconfig:"demand_co2_levels" default:"800:3,1000:4,1200:5,1400:6"`
+	DemandRHLevels      []string      `envconfig:"demand_rh_levels" default:"60:4,70:5,80:6"`
+	DemandCO2Hysteresis float64       `envconfig:"demand_co2_hysteresis" default:"50"`
+	DemandRHHysteresis  float64       `envconfig:"demand_rh_hysteresis" default:"3"`
+	DemandMinSpeed      byte          `envconfig:"demand_min_speed" default:"2"`
+	DemandMaxSpeed      byte          `envconfig:"demand_max_speed" default:"6"`
+	DemandMinHold       time.Duration `envconfig:"demand_min_hold" default:"10m"`
+	DemandSensorTimeout time.Duration `envconfig:"demand_sensor_timeout" default:"15m"`
+
+	SpikeDetection      bool          `envconfig:"spike_detection" default:"false"`
+	SpikeRHTopic        string        `envconfig:"spike_rh_topic"`
+	SpikeSpeed          byte          `envconfig:"spike_speed" default:"6"`
+	SpikeRise           float64       `envconfig:"spike_rise" default:"10"`
+	SpikeDecay          float64       `envconfig:"spike_decay" default:"3"`
+	SpikeBaselineWindow time.Duration `envconfig:"spike_baseline_window" default:"1h"`
+	SpikeMaxDuration    time.Duration `envconfig:"spike_max_duration" default:"2h"`
+
+	NightCooling       bool    `envconfig:"night_cooling" default:"false"`
+	NightCoolingStart  string  `envconfig:"night_cooling_start" default:"22:00"`
+	NightCoolingEnd    string  `envconfig:"night_cooling_end" default:"07:00"`
+	NightCoolingTarget float64 `envconfig:"night_cooling_target" default:"23"`
+	NightCoolingSpread float64 `envconfig:"night_cooling_spread" default:"3"`
+	NightCoolingSpeed  byte    `envconfig:"night_cooling_speed" default:"6"`
+
+	FrostProtection   bool          `envconfig:"frost_protection" default:"false"`
+	FrostThreshold    float64       `envconfig:"frost_threshold" default:"2"`
+	FrostHysteresis   float64       `envconfig:"frost_hysteresis" default:"2"`
+	FrostLookahead    time.Duration `envconfig:"frost_lookahead" default:"30m"`
+	FrostOutdoorLimit float64       `envconfig:"frost_outdoor_limit" default:"0"`
+	FrostSpeed        byte          `envconfig:"frost_speed" default:"1"`
+
+	NotifyUrls           []string      `envconfig:"notify_urls"`
+	NotifyRepeatInterval time.Duration `envconfig:"notify_repeat_interval" default:"1h"`
+	NotifyBusSilent      time.Duration `envconfig:"notify_bus_silent" default:"10m"`
+	NotifyMqttDown       time.Duration `envconfig:"notify_mqtt_down" default:"10m"`
+
+	CaptureFile     string `envconfig:"capture_file"`
+	CaptureMaxSize  int64  `envconfig:"capture_max_size" default:"10485760"`
+	CaptureMaxFiles int    `envconfig:"capture_max_files" default:"5"`
+
+	ReplayFile  string  `envconfig:"replay_file"`
+	ReplaySpeed float64 `envconfig:"replay_speed" default:"1"`
 }
 
-var (
-	config Config
-
-	logDebug *log.Logger
-	logInfo  *log.Logger
-	logError *log.Logger
+// Gateway bridges the vallox bus and mqtt, holding the latest values, controllers and speed change state
+type Gateway struct {
+	device    valloxBus
+	mqtt      publisher
+	cache     map[byte]cacheEntry
+	words     map[string]wordEntry // 16 bit values by topic, combined when the lower byte is received
+	state     *persistentState
+	stateFile string
+	discovery map[string][]haEntity
+
+	schedule     *scheduleController
+	boost        *boostController
+	demand       *demandController
+	spike        *spikeController
+	cooling      *coolingController
+	frost        *frostController
+	energyMeters []*energyMeter
+	energyMaxGap time.Duration
+	history      *historyStore // nil without HISTORY_DIR
+	influx       *influxOutput // nil without INFLUX_URL
+	capture      *busCapture   // nil without CAPTURE_FILE
+	busStats     *busStats
+	notifier     *notifier
+
+	efficiencyMinSpread float64
+	efficiencyAvailable string
+	sniff               bool
+	enableState         bool
+	enableHomie         bool
 
 	updateSpeed          byte
 	updateSpeedRequested time.Time
 	currentSpeed         byte
 	currentSpeedUpdated  time.Time
+	manualSpeed          byte
+	speedWinner          speedRequest
+
+	lastEvent          time.Time
+	mqttDisconnectedAt time.Time // zero while connected
+	serviceCounter     int
+
+	speedRequests  chan byte
+	speedSend      chan byte
+	haStatus       chan string
+	stateChanged   chan bool
+	mqttConnection chan bool
+}
+
+// newGateway creates gateway for the bus with controllers enabled in config, mqtt is set by the caller
+func newGateway(c Config, state *persistentState, bus valloxBus) *Gateway {
+	discovery := make(map[string][]haEntity)
+	for component, entries := range baseDiscovery {
+		discovery[component] = append([]haEntity{}, entries...)
+	}
+
+	g := &Gateway{
+		cache:          make(map[byte]cacheEntry),
+		words:          make(map[string]wordEntry),
+		state:          state,
+		stateFile:      c.StateFile,
+		discovery:      discovery,
+		energyMeters:   newEnergyMeters(c, discovery),
+		energyMaxGap:   c.EnergyMaxGap,
+		schedule:       newSchedule(c, discovery),
+		boost:          newBoost(c, state, discovery),
+		demand:         newDemand(c, discovery),
+		spike:          newSpike(c, state, discovery),
+		cooling:        newCooling(c, state, discovery),
+		frost:          newFrost(c, discovery),
+		notifier:       newNotifier(c),
+		serviceCounter: -1,
+		speedRequests:  make(chan byte, 10),
+		speedSend:      make(chan byte, 10),
+		haStatus:       make(chan string, 10),
+		stateChanged:   make(chan bool, 10),
+		mqttConnection: make(chan bool, 10),
+
+		efficiencyMinSpread: c.EfficiencyMinSpread,
+		sniff:               c.EnableSniff,
+		enableState:         c.EnableState,
+		enableHomie:         c.EnableHomie,
+	}
+	g.busStats = newBusStats(discovery)
+	g.device = statsBus{valloxBus: bus, stats: g.busStats}
+	if c.EnableSniff {
+		logInfo.Printf("sniffing bus traffic to vallox/bus")
+	}
+	if c.SniffPassive {
+		logInfo.Printf("passive mode, speed changes and queries are logged and not sent to the bus")
+		g.device = passiveBus{g.device}
+	}
+	return g
+}
 
-	speedUpdateRequest = make(chan byte, 10)
-	speedUpdateSend    = make(chan byte, 10)
+// publisher publishes mqtt messages, implemented by mqtt client
+type publisher interface {
+	Publish(topic string, qos byte, retained bool, payload interface{}) mqttClient.Token
+}
+
+// stateValue is a single value in the aggregate state document
+type stateValue struct {
+	Value interface{} `json:"value"`
+	Time  time.Time   `json:"time"`
+}
+
+var (
+	config Config
 
-	homeassistantStatus = make(chan string, 10)
+	logDebug *log.Logger
+	logInfo  *log.Logger
+	logError *log.Logger
 )
 
-func init() {
+func loadConfig() {
 
 	err := envconfig.Process("vallox", &config)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
-
-	initLogging()
+	if config.SerialDevice == "" && config.ReplayFile == "" {
+		log.Fatal("required key SERIAL_DEVICE missing value")
+	}
+	if config.InfluxBatchSize < 1 {
+		log.Fatal("INFLUX_BATCH_SIZE should be at least 1")
+	}
+	if config.InfluxFlushInterval <= 0 {
+		log.Fatal("INFLUX_FLUSH_INTERVAL should be positive")
+	}
 }
 
 func main() {
 
-	mqtt := connectMqtt()
+	loadConfig()
+
+	initLogging()
+
+	var valloxDevice valloxBus
+	if config.ReplayFile != "" {
+		valloxDevice = openReplay()
+	} else {
+		valloxDevice = connectVallox()
+	}
+
+	state, err := loadPersisted(config.StateFile)
+	if err != nil {
+		logError.Fatalf("cannot load state file %s: %v", config.StateFile, err)
+	}
+	if config.StateFile != "" {
+		logInfo.Printf("loaded state from %s", config.StateFile)
+	}
+
+	gateway := newGateway(config, state, valloxDevice)
+
+	if config.HistoryDir != "" {
+		gateway.history = newHistory(config)
+		go gateway.history.run()
+	}
+
+	if config.CaptureFile != "" {
+		gateway.capture = newCapture(config)
+		go gateway.capture.run()
+	}
+
+	if config.InfluxUrl != "" {
+		gateway.influx = newInflux(config)
+		go gateway.influx.run()
+	}
 
-	cache := make(map[byte]cacheEntry)
+	mqtt := gateway.connectMqtt(config)
+	gateway.mqtt = mqtt
 
-	announceMeToMqttDiscovery(mqtt, cache)
+	gateway.announceDiscovery()
 
-	valloxDevice := connectVallox()
+	publishFaults(mqtt, gateway.state)
+
+	// save state and disconnect on shutdown
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		logInfo.Printf("received %v, stopping", <-signals)
+		close(stop)
+	}()
+
+	gateway.run(stop)
+
+	if config.EnableHomie {
+		disconnectHomie(mqtt)
+	}
+	mqtt.Disconnect(250)
+}
+
+// run handles bus events, mqtt commands and timed updates until stop is closed
+func (g *Gateway) run(stop <-chan struct{}) {
+	stateTimer := time.NewTimer(stateDebounce)
+	stateTimer.Stop()
+	var stateFirstChange time.Time // zero when state is published
+
+	energyTicker := time.NewTicker(energyInterval)
+	serviceTicker := time.NewTicker(time.Hour)
+	scheduleTicker := time.NewTicker(scheduleInterval)
+	boostTicker := time.NewTicker(boostInterval)
+	controlTicker := time.NewTicker(controlInterval)
+	busStatsTicker := time.NewTicker(busStatsInterval)
+	persistTicker := time.NewTicker(persistInterval)
+	defer func() {
+		energyTicker.Stop()
+		serviceTicker.Stop()
+		scheduleTicker.Stop()
+		boostTicker.Stop()
+		controlTicker.Stop()
+		busStatsTicker.Stop()
+		persistTicker.Stop()
+	}()
 
 	for {
 		select {
-		case event := <-valloxDevice.Events():
-			handleValloxEvent(valloxDevice, event, cache, mqtt)
-		case request := <-speedUpdateRequest:
-			if hasSameRecentSpeed(request) {
-				continue
+		case <-stop:
+			g.saveState()
+			return
+		case event := <-g.device.Events():
+			g.handleValloxEvent(event)
+		case request := <-g.speedRequests:
+			g.requestSpeed(request)
+		case <-g.speedSend:
+			g.sendSpeed()
+		case <-g.stateChanged:
+			now := time.Now()
+			if stateFirstChange.IsZero() {
+				stateFirstChange = now
 			}
-			updateSpeed = request
-			updateSpeedRequested = time.Now()
-			speedUpdateSend <- request
-		case <-speedUpdateSend:
-			sendSpeed(valloxDevice)
-		case status := <-homeassistantStatus:
+			stateTimer.Reset(stateDelay(stateFirstChange, now))
+		case <-stateTimer.C:
+			stateFirstChange = time.Time{}
+			publishState(g.mqtt, g.cache, g.words)
+		case now := <-energyTicker.C:
+			g.updateEnergy(now)
+		case <-persistTicker.C:
+			g.saveState()
+		case now := <-serviceTicker.C:
+			publishService(g.mqtt, g.state, g.cache, now)
+		case now := <-scheduleTicker.C:
+			g.schedule.update(g.mqtt, now)
+			g.arbitrateSpeed()
+		case command := <-g.schedule.overrides:
+			g.schedule.overrideCommand(command, time.Now())
+			g.schedule.update(g.mqtt, time.Now())
+			g.arbitrateSpeed()
+		case hold := <-g.schedule.holds:
+			g.schedule.hold = hold
+			g.schedule.update(g.mqtt, time.Now())
+			g.arbitrateSpeed()
+		case now := <-boostTicker.C:
+			g.boost.update(g.mqtt, now)
+			g.arbitrateSpeed()
+			g.saveState()
+		case command := <-g.boost.commands:
+			g.boost.command(command, time.Now())
+			g.boost.update(g.mqtt, time.Now())
+			g.arbitrateSpeed()
+			g.saveState()
+		case now := <-controlTicker.C:
+			g.demand.update(g.mqtt, now)
+			g.spike.update(g.mqtt, g.cache, now)
+			g.cooling.update(g.mqtt, g.cache, now)
+			g.frost.update(g.mqtt, g.cache, now)
+			g.arbitrateSpeed()
+			g.notifier.checkHealth(g.cache, now, g.lastEvent, g.mqttDisconnectedAt)
+		case now := <-busStatsTicker.C:
+			g.busStats.publish(g.mqtt, now)
+		case connected := <-g.mqttConnection:
+			if connected {
+				g.mqttDisconnectedAt = time.Time{}
+			} else {
+				g.mqttDisconnectedAt = time.Now()
+			}
+		case reading := <-g.demand.readingUpdates:
+			g.demand.readings[reading.sensor] = reading
+			g.demand.update(g.mqtt, time.Now())
+			g.arbitrateSpeed()
+		case enabled := <-g.demand.enableRequests:
+			g.demand.enabled = enabled
+			g.demand.speed = 0 // apply current demand when enabled again
+			g.demand.update(g.mqtt, time.Now())
+			g.arbitrateSpeed()
+		case reading := <-g.spike.readings:
+			g.spike.reading = reading
+		case tune := <-g.spike.tunes:
+			g.spike.tune(tune)
+			g.spike.update(g.mqtt, g.cache, time.Now())
+			g.arbitrateSpeed()
+			g.saveState()
+		case change := <-g.cooling.changes:
+			g.cooling.change(change)
+			g.cooling.update(g.mqtt, g.cache, time.Now())
+			g.arbitrateSpeed()
+			g.saveState()
+		case status := <-g.haStatus:
 			if status == "online" {
 				// HA became online, send discovery so it knows about entities
-				go announceMeToMqttDiscovery(mqtt, cache)
+				go g.announceDiscovery()
 			} else if status != "offline" {
 				logInfo.Printf("unknown HA status message %s", status)
 			}
@@ -858,52 +675,204 @@ func main() {
 	}
 }
 
-func handleValloxEvent(valloxDev *vallox.Vallox, e vallox.Event, cache map[byte]cacheEntry, mqtt mqttClient.Client) {
-	if !valloxDev.ForMe(e) {
+// handleValloxEvent records and publishes event received from the bus
+func (g *Gateway) handleValloxEvent(e vallox.Event) {
+	forMe := g.device.ForMe(e)
+
+	g.busStats.recordFrame(e, forMe, time.Now())
+
+	if g.capture != nil {
+		g.capture.event(e, forMe, time.Now())
+	}
+
+	if g.sniff {
+		sniffEvent(g.mqtt, e)
+	}
+
+	if !forMe {
 		return // Ignore values not addressed for me
 	}
 
-	val, ok := cache[e.Register]
+	g.lastEvent = time.Now()
+
+	if g.influx != nil {
+		g.influx.write(e, time.Now())
+	}
+
+	if g.history != nil {
+		g.history.record(e, g.cache, time.Now())
+	}
+
+	val, ok := g.cache[e.Register]
 	if ok && val.value.RawValue == e.RawValue && time.Since(val.time) < time.Duration(15)*time.Minute {
 		// Some values are not published by the device, so manually republish to keep the device online
-		resendOldValues(valloxDev, mqtt, cache)
-		// we already have that value and have recently published it, no need to publish to mqtt
+		g.resendOldValues()
+		// lower byte completes a word even when it has not changed
+		g.updateWords(e.Register)
+		// we already have that value and have recently published it, no need to publish to g.mqtt
 		return
 	}
 
 	cached := cacheEntry{time: time.Now(), value: e}
-	cache[e.Register] = cached
+	g.cache[e.Register] = cached
 
 	if e.Register == vallox.RegisterCurrentFanSpeed {
-		currentSpeed = byte(e.Value.(int16))
-		currentSpeedUpdated = cached.time
+		g.currentSpeed = byte(e.Value.(int16))
+		g.currentSpeedUpdated = cached.time
+		g.trackManualSpeed(g.currentSpeed, cached.time)
+	}
+
+	go publishValue(g.mqtt, cached.value)
+
+	g.updateWords(e.Register)
+
+	g.publishEfficiency(e.Register)
+
+	g.updateService(e.Register)
+
+	updateFaults(g.mqtt, g.state, g.notifier, e.Register, g.cache)
+
+	g.notifier.updateStatus(e.Register, g.cache)
+
+	if g.enableState {
+		select {
+		case g.stateChanged <- true:
+		default: // publish already pending
+		}
+	}
+}
+
+// wordEntry is a 16 bit value combined from upper and lower byte registers
+type wordEntry struct {
+	time  time.Time
+	value int
+}
+
+// updateWords combines and publishes changed 16 bit values when their lower byte is received.
+// The unit sends the upper byte first, so combining on the upper byte could publish the new
+// upper byte with the old lower byte.
+func (g *Gateway) updateWords(register byte) {
+	for _, e := range registry {
+		if !e.isWord() || e.low != register {
+			continue
+		}
+		value, ok := wordValue(e, g.cache)
+		if !ok {
+			continue
+		}
+		if last, ok := g.words[e.topic]; ok && last.value == value {
+			continue
+		}
+		g.words[e.topic] = wordEntry{time: time.Now(), value: value}
+		go publishTopicValue(g.mqtt, e.topic, fmt.Sprint(value))
+	}
+}
+
+// wordValue combines upper and lower byte registers, returns false until both halves are received
+func wordValue(e registerEntity, cache map[byte]cacheEntry) (int, bool) {
+	high, okHigh := cache[e.register]
+	low, okLow := cache[e.low]
+	if !okHigh || !okLow {
+		return 0, false
+	}
+	return int(high.value.RawValue)<<8 | int(low.value.RawValue), true
+}
+
+// publishState publishes all cached values as a single json document
+func publishState(mqtt publisher, cache map[byte]cacheEntry, words map[string]wordEntry) {
+	state := make(map[string]stateValue)
+	for _, cached := range cache {
+		for topic, value := range eventValues(cached.value) {
+			state[strings.TrimPrefix(topic, "vallox/")] = stateValue{Value: value, Time: cached.time}
+		}
+	}
+	for topic, word := range words {
+		state[strings.TrimPrefix(topic, "vallox/")] = stateValue{Value: word.value, Time: word.time}
 	}
 
-	go publishValue(mqtt, cached.value)
+	jsonmsg, err := json.Marshal(state)
+	if err != nil {
+		logError.Printf("Cannot marshal json %v", err)
+		return
+	}
+	go publish(mqtt, topicState, jsonmsg)
 }
 
-func sendSpeed(valloxDevice *vallox.Vallox) {
-	if time.Since(updateSpeedRequested) < time.Duration(5)*time.Second {
+// sendSpeed sends requested speed to the unit once the request has settled
+func (g *Gateway) sendSpeed() {
+	if time.Since(g.updateSpeedRequested) < time.Duration(5)*time.Second {
 		// Less than second old, retry later
+		speed := g.updateSpeed
 		go func() {
 			time.Sleep(time.Duration(1000) * time.Millisecond)
-			speedUpdateSend <- updateSpeed
+			g.speedSend <- speed
 		}()
-	} else if currentSpeed != updateSpeed || time.Since(currentSpeedUpdated) > 10*time.Second {
-		logDebug.Printf("sending speed update to %x", updateSpeed)
-		currentSpeed = updateSpeed
-		currentSpeedUpdated = time.Now()
-		valloxDevice.SetSpeed(updateSpeed)
+	} else if g.currentSpeed != g.updateSpeed || time.Since(g.currentSpeedUpdated) > 10*time.Second {
+		logDebug.Printf("sending speed update to %x", g.updateSpeed)
+		g.currentSpeed = g.updateSpeed
+		g.currentSpeedUpdated = time.Now()
+		g.device.SetSpeed(g.updateSpeed)
 		time.Sleep(time.Duration(20) * time.Millisecond)
-		valloxDevice.Query(vallox.RegisterCurrentFanSpeed)
+		g.device.Query(vallox.RegisterCurrentFanSpeed)
 	}
 }
 
-func hasSameRecentSpeed(request byte) bool {
-	return currentSpeed == request && time.Since(currentSpeedUpdated) < time.Duration(10)*time.Second
+// requestSpeed handles manual speed change, limited while frost protection is active
+func (g *Gateway) requestSpeed(request byte) {
+	g.manualSpeed = request
+	g.arbitrateSpeed()
+	g.queueSpeed(request)
+}
+
+// queueSpeed queues speed change, limited by frost protection, unless the same speed was just sent
+func (g *Gateway) queueSpeed(request byte) {
+	request = g.frost.limit(request)
+	if g.hasSameRecentSpeed(request) {
+		return
+	}
+	g.updateSpeed = request
+	g.updateSpeedRequested = time.Now()
+	g.speedSend <- request
+}
+
+func (g *Gateway) hasSameRecentSpeed(request byte) bool {
+	return g.currentSpeed == request && time.Since(g.currentSpeedUpdated) < time.Duration(10)*time.Second
+}
+
+// eventSource delivers frames seen on the bus
+type eventSource interface {
+	Events() <-chan vallox.Event
+	ForMe(e vallox.Event) bool
 }
 
-func connectVallox() *vallox.Vallox {
+// registerReader requests the unit to send register value
+type registerReader interface {
+	Query(register byte)
+}
+
+// speedWriter changes fan speed of the unit
+type speedWriter interface {
+	SetSpeed(speed byte)
+}
+
+// valloxBus is the source of bus events and target of commands, either the serial device or a replay
+type valloxBus interface {
+	eventSource
+	registerReader
+	speedWriter
+}
+
+// serialBus is the vallox device on serial port
+type serialBus struct {
+	device *vallox.Vallox
+}
+
+func (b serialBus) Events() <-chan vallox.Event { return b.device.Events() }
+func (b serialBus) ForMe(e vallox.Event) bool   { return b.device.ForMe(e) }
+func (b serialBus) SetSpeed(speed byte)         { b.device.SetSpeed(speed) }
+func (b serialBus) Query(register byte)         { b.device.Query(register) }
+
+func connectVallox() valloxBus {
 	cfg := vallox.Config{Device: config.SerialDevice, EnableWrite: config.EnableWrite, LogDebug: logDebug}
 
 	logInfo.Printf("connecting to vallox serial port %s write enabled: %v", cfg.Device, cfg.EnableWrite)
@@ -914,40 +883,45 @@ func connectVallox() *vallox.Vallox {
 		logError.Fatalf("error opening Vallox device %s: %v", config.SerialDevice, err)
 	}
 
-	return valloxDevice
+	return serialBus{device: valloxDevice}
 }
 
-func connectMqtt() mqttClient.Client {
+// connectMqtt connects to the broker of c
+func (g *Gateway) connectMqtt(c Config) mqttClient.Client {
 
 	opts := mqttClient.NewClientOptions().
-		AddBroker(config.MqttUrl).
-		SetClientID(config.MqttClientId).
+		AddBroker(c.MqttUrl).
+		SetClientID(c.MqttClientId).
 		SetOrderMatters(false).
 		SetKeepAlive(150 * time.Second).
 		SetAutoReconnect(true).
-		SetConnectionLostHandler(connectionLostHandler).
-		SetOnConnectHandler(connectHandler).
+		SetConnectionLostHandler(g.connectionLostHandler).
+		SetOnConnectHandler(g.connectHandler).
 		SetReconnectingHandler(reconnectHandler)
 
-	if len(config.MqttUser) > 0 {
-		opts = opts.SetUsername(config.MqttUser)
+	if c.EnableHomie {
+		opts = opts.SetWill(homieBase+"/$state", "lost", 1, true)
+	}
+
+	if len(c.MqttUser) > 0 {
+		opts = opts.SetUsername(c.MqttUser)
 	}
 
-	if len(config.MqttPwd) > 0 {
-		opts = opts.SetPassword(config.MqttPwd)
+	if len(c.MqttPwd) > 0 {
+		opts = opts.SetPassword(c.MqttPwd)
 	}
 
 	logInfo.Printf("connecting to mqtt %s client id %s user %s", opts.Servers, opts.ClientID, opts.Username)
 
-	c := mqttClient.NewClient(opts)
-	if token := c.Connect(); token.Wait() && token.Error() != nil {
+	client := mqttClient.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
 		panic(token.Error())
 	}
 
-	return c
+	return client
 }
 
-func changeSpeedMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
+func (g *Gateway) changeSpeedMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
 	body := string(msg.Payload())
 	topic := msg.Topic()
 	logInfo.Printf("received speed change %s to %s", body, topic)
@@ -955,53 +929,135 @@ func changeSpeedMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
 	if err != nil {
 		logError.Printf("cannot parse speed from body %s", body)
 	} else {
-		speedUpdateRequest <- byte(spd)
+		g.speedRequests <- byte(spd)
 	}
 }
 
-func haStatusMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
+func (g *Gateway) haStatusMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
 	body := string(msg.Payload())
-	homeassistantStatus <- body
+	g.haStatus <- body
 }
 
-func subscribe(mqtt mqttClient.Client) {
+func (g *Gateway) subscribe(mqtt mqttClient.Client) {
 	logDebug.Print("subscribing to topics")
-	mqtt.Subscribe("homeassistant/status", 0, haStatusMessage)
-	mqtt.Subscribe("vallox/fan/currentSpeed/set", 0, changeSpeedMessage)
-	// TODO: Other set topics
+	mqtt.Subscribe("homeassistant/status", 0, g.haStatusMessage)
+	g.subscribeRegistry(mqtt)
+
+	mqtt.Subscribe(topicBoostSet, 0, g.boost.message)
+
+	// demand and spike detection may read the same sensor topic
+	subscribeSensors(mqtt, append(g.demand.sensorRoutes(), g.spike.sensorRoutes()...))
+
+	if g.demand.configured() {
+		g.demand.subscribe(mqtt)
+	}
+
+	if g.spike.enabled {
+		g.spike.subscribe(mqtt)
+	}
+
+	if g.cooling.enabled {
+		g.cooling.subscribe(mqtt)
+	}
+
+	if g.schedule.enabled() {
+		g.schedule.subscribe(mqtt)
+	}
+
+	if g.enableHomie {
+		g.subscribeHomie(mqtt)
+	}
+
+	if g.history != nil {
+		mqtt.Subscribe(topicHistoryGet, 0, g.history.requestMessage)
+	}
 }
 
-func resendOldValues(device *vallox.Vallox, mqtt mqttClient.Client, cache map[byte]cacheEntry) {
+func (g *Gateway) resendOldValues() {
 	// Speed is not automatically published by Vallox, so manually refresh the value
 	now := time.Now()
 	validTime := now.Add(time.Duration(-15) * time.Minute)
-	if cached, ok := cache[vallox.RegisterCurrentFanSpeed]; ok && cached.time.Before(validTime) {
-		device.Query(vallox.RegisterCurrentFanSpeed)
+	if cached, ok := g.cache[vallox.RegisterCurrentFanSpeed]; ok && cached.time.Before(validTime) {
+		g.device.Query(vallox.RegisterCurrentFanSpeed)
 	}
 }
 
-func publishValue(mqtt mqttClient.Client, event vallox.Event) {
+func publishValue(mqtt publisher, event vallox.Event) {
+
+	for topic, value := range eventValues(event) {
+		publishTopicValue(mqtt, topic, fmt.Sprint(value))
+	}
+
+	if config.EnableRaw {
+		publish(mqtt, fmt.Sprintf("vallox/raw/%x", event.Register), fmt.Sprintf("%d", event.RawValue))
+	}
+}
 
-	if topic, ok := topicMap[event.Register]; ok {
+// eventValues decodes the event to values by topic, including flags
+func eventValues(event vallox.Event) map[string]interface{} {
+	values := make(map[string]interface{})
 
-		publish(mqtt, topic, fmt.Sprint(event.Value))
+	for _, e := range registry {
+		if e.register == event.Register && !e.isWord() {
+			values[e.topic] = e.decode(event)
+		}
 	}
 
-	if registerFlags, ok := topicFlagMap[event.Register]; ok {
-		for flag, topic := range registerFlags {
-			publish(mqtt, topic, fmt.Sprint(event.RawValue&flag == flag))
+	return values
+}
+
+// numericValue converts decoded value to float, booleans are 0 or 1
+func numericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1, true
 		}
+		return 0, true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
 	}
+}
 
-	if config.EnableRaw {
-		publish(mqtt, fmt.Sprintf("vallox/raw/%x", event.Register), fmt.Sprintf("%d", event.RawValue))
+// publishTopicValue publishes decoded value to its topic and enabled alternative outputs
+func publishTopicValue(mqtt publisher, topic string, value string) {
+	publish(mqtt, topic, value)
+
+	if config.EnableHomie {
+		publishHomieValue(mqtt, topic, value)
 	}
 }
 
-func publish(mqtt mqttClient.Client, topic string, msg interface{}) {
+func publish(mqtt publisher, topic string, msg interface{}) {
+	publishMessage(mqtt, topic, false, msg)
+}
+
+func publishRetained(mqtt publisher, topic string, msg interface{}) {
+	publishMessage(mqtt, topic, true, msg)
+}
+
+func publishMessage(mqtt publisher, topic string, retained bool, msg interface{}) {
 	logDebug.Printf("publishing to %s msg %s", msg, topic)
 
-	t := mqtt.Publish(topic, 0, false, msg)
+	t := mqtt.Publish(topic, 0, retained, msg)
 	go func() {
 		_ = t.Wait()
 		if t.Error() != nil {
@@ -1010,28 +1066,36 @@ func publish(mqtt mqttClient.Client, topic string, msg interface{}) {
 	}()
 }
 
-func announceMeToMqttDiscovery(mqtt mqttClient.Client, cache map[byte]cacheEntry) {
-	for key, entries := range discovery {
+// announceDiscovery publishes Home Assistant discovery of all entities
+func (g *Gateway) announceDiscovery() {
+	mqtt := g.mqtt
+	for key, entries := range g.discovery {
 		for _, msg := range entries {
 			jsonmsg, err := json.Marshal(msg)
 			if err != nil {
 				logError.Printf("Cannot marshal json %v", err)
 				continue
 			}
-			publish(mqtt, fmt.Sprintf("homeassistant/%s/%s/config", key, msg["unique_id"].(string)), jsonmsg)
+			publish(mqtt, fmt.Sprintf("homeassistant/%s/%s/config", key, msg.UniqueId), jsonmsg)
 		}
 	}
 }
 
-func connectionLostHandler(client mqttClient.Client, err error) {
+func (g *Gateway) connectionLostHandler(client mqttClient.Client, err error) {
 	options := client.OptionsReader()
 	logError.Printf("MQTT connection to %s lost %v", options.Servers(), err)
+	g.mqttConnection <- false
 }
 
-func connectHandler(client mqttClient.Client) {
+func (g *Gateway) connectHandler(client mqttClient.Client) {
 	options := client.OptionsReader()
 	logInfo.Printf("MQTT connected to %s", options.Servers())
-	subscribe(client)
+	g.mqttConnection <- true
+	g.subscribe(client)
+
+	if g.enableHomie {
+		announceHomie(client)
+	}
 }
 
 func reconnectHandler(client mqttClient.Client, options *mqttClient.ClientOptions) {
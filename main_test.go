@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqttClient "github.com/eclipse/paho.mqtt.golang"
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+const (
+	testAddress  byte = 0x22
+	otherAddress byte = 0x21
+)
+
+type testMessage struct {
+	topic    string
+	retained bool
+	payload  string
+}
+
+// testPublisher records published messages
+type testPublisher struct {
+	mu       sync.Mutex
+	messages []testMessage
+}
+
+func (p *testPublisher) Publish(topic string, qos byte, retained bool, payload interface{}) mqttClient.Token {
+	body := fmt.Sprint(payload)
+	if b, ok := payload.([]byte); ok {
+		body = string(b)
+	}
+	p.record(testMessage{topic: topic, retained: retained, payload: body})
+	return &mqttClient.DummyToken{}
+}
+
+func (p *testPublisher) record(msg testMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.messages = append(p.messages, msg)
+}
+
+// payloads returns payloads published to topic
+func (p *testPublisher) payloads(topic string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var payloads []string
+	for _, msg := range p.messages {
+		if msg.topic == topic {
+			payloads = append(payloads, msg.payload)
+		}
+	}
+	return payloads
+}
+
+// waitFor waits until count messages have been published to topic
+func (p *testPublisher) waitFor(t *testing.T, topic string, count int) []string {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		payloads := p.payloads(topic)
+		if len(payloads) >= count {
+			return payloads
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d messages to %s, got %v", count, topic, payloads)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// testBus records commands sent to the bus, frames to testAddress are for me
+type testBus struct {
+	events chan vallox.Event
+
+	mu      sync.Mutex
+	speeds  []byte
+	queries []byte
+}
+
+func (b *testBus) Events() <-chan vallox.Event {
+	return b.events
+}
+
+func (b *testBus) ForMe(e vallox.Event) bool {
+	return e.Destination == testAddress
+}
+
+func (b *testBus) SetSpeed(speed byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.speeds = append(b.speeds, speed)
+}
+
+func (b *testBus) Query(register byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queries = append(b.queries, register)
+}
+
+func (b *testBus) sentSpeeds() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.speeds...)
+}
+
+func (b *testBus) sentQueries() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.queries...)
+}
+
+func TestMain(m *testing.M) {
+	initLogging()
+	os.Exit(m.Run())
+}
+
+func newTestGateway() (*Gateway, *testBus, *testPublisher) {
+	bus := &testBus{events: make(chan vallox.Event)}
+	mqtt := &testPublisher{}
+	g := newGateway(Config{}, newPersistentState(), bus)
+	g.mqtt = mqtt
+	return g, bus, mqtt
+}
+
+func TestHandleValloxEventDedup(t *testing.T) {
+	g, bus, mqtt := newTestGateway()
+
+	e := vallox.Event{Source: 0x11, Destination: testAddress, Register: vallox.RegisterOutdoorTemp, RawValue: 100, Value: int16(5)}
+	g.handleValloxEvent(e)
+	if payloads := mqtt.waitFor(t, topicTempOutdoor, 1); payloads[0] != "5" {
+		t.Errorf("expected outdoor temperature 5, got %s", payloads[0])
+	}
+	first := g.cache[e.Register].time
+
+	g.handleValloxEvent(e)
+	time.Sleep(50 * time.Millisecond)
+	if payloads := mqtt.payloads(topicTempOutdoor); len(payloads) != 1 {
+		t.Errorf("expected unchanged value not to be published again, got %v", payloads)
+	}
+	if !g.cache[e.Register].time.Equal(first) {
+		t.Errorf("expected unchanged value not to update cache")
+	}
+
+	e.RawValue, e.Value = 101, int16(6)
+	g.handleValloxEvent(e)
+	if payloads := mqtt.waitFor(t, topicTempOutdoor, 2); payloads[1] != "6" {
+		t.Errorf("expected changed outdoor temperature 6, got %s", payloads[1])
+	}
+
+	if queries := bus.sentQueries(); len(queries) != 0 {
+		t.Errorf("expected no queries, got %v", queries)
+	}
+}
+
+func TestHandleValloxEventNotForMe(t *testing.T) {
+	g, _, mqtt := newTestGateway()
+
+	g.handleValloxEvent(vallox.Event{Source: 0x11, Destination: otherAddress, Register: vallox.RegisterOutdoorTemp, RawValue: 100, Value: int16(5)})
+	time.Sleep(50 * time.Millisecond)
+
+	if _, ok := g.cache[vallox.RegisterOutdoorTemp]; ok {
+		t.Errorf("expected frame to other panel not to be cached")
+	}
+	if payloads := mqtt.payloads(topicTempOutdoor); len(payloads) != 0 {
+		t.Errorf("expected frame to other panel not to be published, got %v", payloads)
+	}
+}
+
+func TestResendOldSpeed(t *testing.T) {
+	g, bus, _ := newTestGateway()
+
+	g.cache[vallox.RegisterCurrentFanSpeed] = cacheEntry{
+		time:  time.Now().Add(-20 * time.Minute),
+		value: vallox.Event{Register: vallox.RegisterCurrentFanSpeed, RawValue: 3, Value: int16(3)},
+	}
+	e := vallox.Event{Source: 0x11, Destination: testAddress, Register: vallox.RegisterOutdoorTemp, RawValue: 100, Value: int16(5)}
+	g.cache[e.Register] = cacheEntry{time: time.Now(), value: e}
+
+	g.handleValloxEvent(e)
+
+	if queries := bus.sentQueries(); len(queries) != 1 || queries[0] != vallox.RegisterCurrentFanSpeed {
+		t.Errorf("expected stale fan speed to be queried, got %v", queries)
+	}
+}
+
+func TestEventValuesFlags(t *testing.T) {
+	values := eventValues(vallox.Event{Register: vallox.RegisterIO08, RawValue: vallox.IO08FlagSummerMode})
+
+	if values[topicIO8SummerMode] != true {
+		t.Errorf("expected summer mode on, got %v", values[topicIO8SummerMode])
+	}
+	if values[topicIO8ErrorRelay] != false {
+		t.Errorf("expected error relay off, got %v", values[topicIO8ErrorRelay])
+	}
+	for _, e := range registry {
+		if e.register != vallox.RegisterIO08 || e.flag == 0 {
+			continue
+		}
+		if _, ok := values[e.topic].(bool); !ok {
+			t.Errorf("expected boolean value for %s, got %v", e.topic, values[e.topic])
+		}
+	}
+}
+
+func TestStateDelay(t *testing.T) {
+	first := time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		since time.Duration
+		delay time.Duration
+	}{
+		{0, stateDebounce},
+		{5 * time.Second, stateDebounce},
+		{9 * time.Second, time.Second},
+		{stateMaxDelay, 0},
+		{time.Minute, 0},
+	}
+	for _, test := range tests {
+		if delay := stateDelay(first, first.Add(test.since)); delay != test.delay {
+			t.Errorf("%v after first change: expected delay %v, got %v", test.since, test.delay, delay)
+		}
+	}
+}
+
+func TestSpeedCommandFlow(t *testing.T) {
+	g, bus, _ := newTestGateway()
+
+	g.requestSpeed(4)
+	select {
+	case speed := <-g.speedSend:
+		if speed != 4 {
+			t.Fatalf("expected speed 4 to be sent, got %d", speed)
+		}
+	default:
+		t.Fatal("expected speed request to be queued")
+	}
+
+	// request is retried later while it is recent
+	g.sendSpeed()
+	if speeds := bus.sentSpeeds(); len(speeds) != 0 {
+		t.Fatalf("expected recent request not to be sent yet, got %v", speeds)
+	}
+	select {
+	case <-g.speedSend:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected recent request to be retried")
+	}
+
+	g.updateSpeedRequested = time.Now().Add(-6 * time.Second)
+	g.sendSpeed()
+	if speeds := bus.sentSpeeds(); len(speeds) != 1 || speeds[0] != 4 {
+		t.Errorf("expected speed 4 to be set, got %v", speeds)
+	}
+	if queries := bus.sentQueries(); len(queries) != 1 || queries[0] != vallox.RegisterCurrentFanSpeed {
+		t.Errorf("expected fan speed to be queried after setting, got %v", queries)
+	}
+
+	// same speed is not requested again
+	g.requestSpeed(4)
+	select {
+	case speed := <-g.speedSend:
+		t.Errorf("expected same recent speed not to be queued, got %d", speed)
+	default:
+	}
+
+	// speed reported by the unit is tracked
+	g.handleValloxEvent(vallox.Event{Source: 0x11, Destination: testAddress, Register: vallox.RegisterCurrentFanSpeed, RawValue: 2, Value: int16(2)})
+	if g.currentSpeed != 2 {
+		t.Errorf("expected current speed 2, got %d", g.currentSpeed)
+	}
+}
+
+func TestSpeedCommandFrostLimit(t *testing.T) {
+	g, _, _ := newTestGateway()
+	g.frost.speed = 1
+	g.frost.active = true
+
+	g.requestSpeed(5)
+	if g.updateSpeed != 1 {
+		t.Errorf("expected speed to be limited to 1, got %d", g.updateSpeed)
+	}
+
+	// requested speed is restored when protection ends
+	g.frost.active = false
+	g.arbitrateSpeed()
+	if g.updateSpeed != 5 {
+		t.Errorf("expected requested speed 5 after frost protection, got %d", g.updateSpeed)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	g, _, mqtt := newTestGateway()
+	g.announceDiscovery()
+
+	count := 0
+	for component, entries := range g.discovery {
+		for _, entry := range entries {
+			count++
+			topic := fmt.Sprintf("homeassistant/%s/%s/config", component, entry.UniqueId)
+			payloads := mqtt.payloads(topic)
+			if len(payloads) != 1 {
+				t.Errorf("expected one discovery message to %s, got %d", topic, len(payloads))
+				continue
+			}
+
+			var msg map[string]interface{}
+			if err := json.Unmarshal([]byte(payloads[0]), &msg); err != nil {
+				t.Errorf("invalid discovery json in %s: %v", topic, err)
+				continue
+			}
+			if msg["unique_id"] != entry.UniqueId || msg["name"] != entry.Name {
+				t.Errorf("unexpected discovery message in %s: %s", topic, payloads[0])
+			}
+			if _, ok := msg["device"]; !ok {
+				t.Errorf("expected device in %s", topic)
+			}
+			if _, ok := msg["state_topic"]; !ok {
+				t.Errorf("expected state topic in %s", topic)
+			}
+		}
+	}
+
+	if len(mqtt.messages) != count {
+		t.Errorf("expected %d discovery messages, got %d", count, len(mqtt.messages))
+	}
+}
+
+// TestWordNotTorn checks that CO2 is published when its lower byte follows the upper byte
+func TestWordNotTorn(t *testing.T) {
+	g, _, mqtt := newTestGateway()
+	frame := func(register byte, raw byte) {
+		g.handleValloxEvent(vallox.Event{Source: 0x11, Destination: testAddress, Register: register, RawValue: raw, Value: int16(raw)})
+	}
+
+	// 0x01ff ppm
+	frame(vallox.RegisterCurrentCO2, 0x01)
+	frame(vallox.RegisterMaximumCO2, 0xff)
+	mqtt.waitFor(t, topicCO2Ppm, 1)
+
+	// 0x0200 ppm, 0x02ff is not published while the lower byte is old
+	frame(vallox.RegisterCurrentCO2, 0x02)
+	time.Sleep(50 * time.Millisecond)
+	if payloads := mqtt.payloads(topicCO2Ppm); len(payloads) != 1 {
+		t.Fatalf("expected upper byte alone not to be published, got %v", payloads)
+	}
+	frame(vallox.RegisterMaximumCO2, 0x00)
+	if payloads := mqtt.waitFor(t, topicCO2Ppm, 2); payloads[1] != "512" {
+		t.Errorf("expected 512 ppm, got %v", payloads)
+	}
+
+	// 0x0300 ppm, unchanged lower byte completes the word
+	frame(vallox.RegisterCurrentCO2, 0x03)
+	frame(vallox.RegisterMaximumCO2, 0x00)
+	if payloads := mqtt.waitFor(t, topicCO2Ppm, 3); payloads[2] != "768" {
+		t.Errorf("expected 768 ppm, got %v", payloads)
+	}
+
+	// repeated frames do not publish unchanged value
+	frame(vallox.RegisterMaximumCO2, 0x00)
+	time.Sleep(50 * time.Millisecond)
+	if payloads := mqtt.payloads(topicCO2Ppm); len(payloads) != 3 {
+		t.Errorf("expected unchanged value not to be published again, got %v", payloads)
+	}
+	if word := g.words[topicCO2Ppm]; word.value != 0x0300 {
+		t.Errorf("expected state value 768, got %d", word.value)
+	}
+}
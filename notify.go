@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+// Notifier posts alerts to webhooks configured with NOTIFY_URLS as "<format>|<url>",
+// format is json, ntfy, gotify or slack.  Same alert is not repeated within repeat interval.
+
+type notification struct {
+	Event   string                 `json:"event"`
+	Title   string                 `json:"title"`
+	Message string                 `json:"message"`
+	Time    time.Time              `json:"time"`
+	Values  map[string]interface{} `json:"values"`
+}
+
+type notifyTarget struct {
+	format string
+	url    string
+}
+
+// values included in notifications
+var notifySummaryTopics = map[string]bool{
+	topicFanCurrentSpeed: true,
+	topicTempOutdoor:     true,
+	topicTempSupply:      true,
+	topicTempExhaustIn:   true,
+	topicTempExhaustOut:  true,
+	topicFaultRaw:        true,
+	topicStatusRaw:       true,
+}
+
+// status flags notified when they turn on
+var notifyStatusFlags = map[byte]string{
+	vallox.StatusFlagFilter:  "Filter guard",
+	vallox.StatusFlagService: "Service reminder",
+}
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// notifier sends the notifications of one gateway
+type notifier struct {
+	targets        []notifyTarget
+	repeatInterval time.Duration
+	busSilent      time.Duration
+	mqttDown       time.Duration
+
+	sent   map[string]time.Time // latest notification by event
+	status byte                 // status flags at the latest update
+}
+
+// newNotifier creates notifier sending to NOTIFY_URLS
+func newNotifier(c Config) *notifier {
+	n := &notifier{
+		repeatInterval: c.NotifyRepeatInterval,
+		busSilent:      c.NotifyBusSilent,
+		mqttDown:       c.NotifyMqttDown,
+		sent:           make(map[string]time.Time),
+	}
+	for _, entry := range c.NotifyUrls {
+		parts := strings.SplitN(strings.TrimSpace(entry), "|", 2)
+		if len(parts) != 2 {
+			logError.Fatalf("notify url %q should be <format>|<url>", entry)
+		}
+		switch parts[0] {
+		case "json", "ntfy", "gotify", "slack":
+		default:
+			logError.Fatalf("unknown notify format %s", parts[0])
+		}
+		n.targets = append(n.targets, notifyTarget{format: parts[0], url: parts[1]})
+	}
+	if len(n.targets) > 0 {
+		logInfo.Printf("sending notifications to %d webhooks", len(n.targets))
+	}
+	return n
+}
+
+// notify sends notification unless the same event has been sent within repeat interval
+func (n *notifier) notify(cache map[byte]cacheEntry, event string, title string, message string) {
+	if len(n.targets) == 0 {
+		return
+	}
+	now := time.Now()
+	if sent, ok := n.sent[event]; ok && now.Sub(sent) < n.repeatInterval {
+		logDebug.Printf("notification %s already sent at %v", event, sent)
+		return
+	}
+	n.sent[event] = now
+
+	msg := notification{Event: event, Title: title, Message: message, Time: now, Values: make(map[string]interface{})}
+	for _, cached := range cache {
+		for topic, value := range eventValues(cached.value) {
+			if notifySummaryTopics[topic] {
+				msg.Values[strings.TrimPrefix(topic, "vallox/")] = value
+			}
+		}
+	}
+
+	for _, target := range n.targets {
+		go sendNotification(target, msg)
+	}
+}
+
+// updateStatus notifies when filter guard or service reminder lights turn on
+func (n *notifier) updateStatus(register byte, cache map[byte]cacheEntry) {
+	if register != vallox.RegisterStatus {
+		return
+	}
+	status := cache[register].value.RawValue
+	for flag, name := range notifyStatusFlags {
+		if status&flag == flag && n.status&flag != flag {
+			n.notify(cache, fmt.Sprintf("status_%x", flag), name, name+" light is on")
+		}
+	}
+	n.status = status
+}
+
+// checkHealth notifies when bus has been silent or mqtt disconnected for too long,
+// mqttDisconnectedAt is zero while connected
+func (n *notifier) checkHealth(cache map[byte]cacheEntry, now time.Time, lastEvent time.Time, mqttDisconnectedAt time.Time) {
+	if !lastEvent.IsZero() && now.Sub(lastEvent) > n.busSilent {
+		n.notify(cache, "bus_silent", "Bus silent", fmt.Sprintf("Nothing received from the bus since %s", lastEvent.Format(time.RFC3339)))
+	}
+	if !mqttDisconnectedAt.IsZero() && now.Sub(mqttDisconnectedAt) > n.mqttDown {
+		n.notify(cache, "mqtt_down", "MQTT disconnected", fmt.Sprintf("MQTT has been disconnected since %s", mqttDisconnectedAt.Format(time.RFC3339)))
+	}
+}
+
+func sendNotification(target notifyTarget, n notification) {
+	var body []byte
+	var err error
+	headers := map[string]string{"Content-Type": "application/json"}
+
+	switch target.format {
+	case "json":
+		body, err = json.Marshal(n)
+	case "ntfy":
+		body = []byte(n.Message + "\n" + notifySummary(n.Values))
+		headers["Content-Type"] = "text/plain; charset=utf-8"
+		headers["Title"] = n.Title
+		headers["Tags"] = "warning"
+	case "gotify":
+		body, err = json.Marshal(map[string]interface{}{
+			"title":    n.Title,
+			"message":  n.Message + "\n" + notifySummary(n.Values),
+			"priority": 5,
+		})
+	case "slack":
+		body, err = json.Marshal(map[string]string{
+			"text": fmt.Sprintf("*%s*\n%s\n%s", n.Title, n.Message, notifySummary(n.Values)),
+		})
+	}
+	if err != nil {
+		logError.Printf("Cannot marshal json %v", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, target.url, bytes.NewReader(body))
+	if err != nil {
+		logError.Printf("invalid notify url %s: %v", target.url, err)
+		return
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		logError.Printf("sending %s notification failed: %v", target.format, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		logError.Printf("sending %s notification failed %s: %s", target.format, resp.Status, bytes.TrimSpace(respBody))
+	}
+}
+
+func notifySummary(values map[string]interface{}) string {
+	var lines []string
+	for key, value := range values {
+		lines = append(lines, fmt.Sprintf("%s: %v", key, value))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
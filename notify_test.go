@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+type notifyRequest struct {
+	path   string
+	header http.Header
+	body   string
+}
+
+// notifyTestServer records notification requests
+type notifyTestServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []notifyRequest
+}
+
+func startNotifyTestServer(t *testing.T) *notifyTestServer {
+	s := &notifyTestServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.requests = append(s.requests, notifyRequest{path: r.URL.Path, header: r.Header, body: string(body)})
+		s.mu.Unlock()
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// waitRequests waits until count requests have been received, notifications are sent asynchronously
+func (s *notifyTestServer) waitRequests(t *testing.T, count int) []notifyRequest {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		requests := append([]notifyRequest(nil), s.requests...)
+		s.mu.Unlock()
+		if len(requests) >= count || time.Now().After(deadline) {
+			if len(requests) != count {
+				t.Fatalf("expected %d notifications, got %d", count, len(requests))
+			}
+			return requests
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// newTestNotifier creates notifier sending json to the test server
+func newTestNotifier(s *notifyTestServer) *notifier {
+	return newNotifier(Config{NotifyUrls: []string{"json|" + s.URL}, NotifyRepeatInterval: time.Hour})
+}
+
+func TestNotifyFormats(t *testing.T) {
+	s := startNotifyTestServer(t)
+	n := notification{
+		Event:   "bus_silent",
+		Title:   "Bus silent",
+		Message: "Nothing received",
+		Time:    time.Date(2024, 1, 12, 12, 0, 0, 0, time.UTC),
+		Values:  map[string]interface{}{"temp/outdoor": int16(-5), "fan/speed": int16(3)},
+	}
+	summary := "fan/speed: 3\ntemp/outdoor: -5"
+
+	tests := []struct {
+		format      string
+		contentType string
+		check       func(t *testing.T, r notifyRequest)
+	}{
+		{"json", "application/json", func(t *testing.T, r notifyRequest) {
+			var got notification
+			if err := json.Unmarshal([]byte(r.body), &got); err != nil || got.Event != n.Event || got.Title != n.Title || !got.Time.Equal(n.Time) || len(got.Values) != 2 {
+				t.Errorf("unexpected json notification %s", r.body)
+			}
+		}},
+		{"ntfy", "text/plain; charset=utf-8", func(t *testing.T, r notifyRequest) {
+			if r.body != n.Message+"\n"+summary || r.header.Get("Title") != n.Title || r.header.Get("Tags") != "warning" {
+				t.Errorf("unexpected ntfy notification %v %q", r.header, r.body)
+			}
+		}},
+		{"gotify", "application/json", func(t *testing.T, r notifyRequest) {
+			var got map[string]interface{}
+			if err := json.Unmarshal([]byte(r.body), &got); err != nil || got["title"] != n.Title || got["message"] != n.Message+"\n"+summary || got["priority"] != 5.0 {
+				t.Errorf("unexpected gotify notification %s", r.body)
+			}
+		}},
+		{"slack", "application/json", func(t *testing.T, r notifyRequest) {
+			var got map[string]string
+			if err := json.Unmarshal([]byte(r.body), &got); err != nil || got["text"] != "*Bus silent*\nNothing received\n"+summary {
+				t.Errorf("unexpected slack notification %s", r.body)
+			}
+		}},
+	}
+	for i, test := range tests {
+		sendNotification(notifyTarget{format: test.format, url: s.URL + "/" + test.format}, n)
+		r := s.waitRequests(t, i+1)[i]
+		if r.path != "/"+test.format || r.header.Get("Content-Type") != test.contentType {
+			t.Errorf("%s: unexpected request to %s with content type %s", test.format, r.path, r.header.Get("Content-Type"))
+		}
+		test.check(t, r)
+	}
+}
+
+func TestNotifyRepeatInterval(t *testing.T) {
+	s := startNotifyTestServer(t)
+	cache := testCache(map[byte]int16{vallox.RegisterOutdoorTemp: -5, vallox.RegisterRH1: 40})
+
+	notifier := newTestNotifier(s)
+	notifier.notify(cache, "bus_silent", "Bus silent", "first")
+	notifier.notify(cache, "bus_silent", "Bus silent", "repeated")
+	notifier.notify(cache, "mqtt_down", "MQTT disconnected", "other event")
+	for _, r := range s.waitRequests(t, 2) {
+		var n notification
+		if err := json.Unmarshal([]byte(r.body), &n); err != nil {
+			t.Fatal(err)
+		}
+		if n.Message == "repeated" {
+			t.Errorf("expected notification not to be repeated within interval")
+		}
+		if _, ok := n.Values["temp/outdoor"]; !ok || len(n.Values) != 1 {
+			t.Errorf("expected summary values only, got %v", n.Values)
+		}
+	}
+
+	// sent again after interval
+	notifier.sent["bus_silent"] = time.Now().Add(-2 * time.Hour)
+	notifier.notify(cache, "bus_silent", "Bus silent", "after interval")
+	if r := s.waitRequests(t, 3)[2]; !strings.Contains(r.body, "after interval") {
+		t.Errorf("expected notification after interval, got %s", r.body)
+	}
+}
+
+func TestNotifyStatusLights(t *testing.T) {
+	s := startNotifyTestServer(t)
+	notifier := newTestNotifier(s)
+	for _, raw := range []byte{0, vallox.StatusFlagFilter, vallox.StatusFlagFilter, 0} {
+		cache := map[byte]cacheEntry{vallox.RegisterStatus: {value: vallox.Event{Register: vallox.RegisterStatus, RawValue: raw}}}
+		notifier.updateStatus(vallox.RegisterStatus, cache)
+	}
+	if r := s.waitRequests(t, 1)[0]; !strings.Contains(r.body, "Filter guard") {
+		t.Errorf("expected filter guard notification, got %s", r.body)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Settings are saved when they change.  Accumulated energy, faults and service date are
+// saved every persistInterval and on shutdown, so the state file is not rewritten on
+// every energy update.
+
+const persistInterval = 15 * time.Minute
+
+// persistentState is kept over restarts in STATE_FILE, owned by the main loop
+type persistentState struct {
+	Energy       map[string]float64   `json:"energy"` // accumulated kWh by meter
+	ServiceReset time.Time            `json:"serviceReset"`
+	Boost        *boostState          `json:"boost,omitempty"`
+	Spike        *spikeSettings       `json:"spike,omitempty"`
+	Cooling      *coolingSettings     `json:"nightCooling,omitempty"`
+	Faults       map[string]time.Time `json:"activeFaults"` // raise time by fault
+	Journal      []faultEvent         `json:"faultJournal"`
+
+	dirty bool // changed since last save
+}
+
+func newPersistentState() *persistentState {
+	return &persistentState{Energy: make(map[string]float64), Faults: make(map[string]time.Time)}
+}
+
+// loadPersisted reads state from file, state is empty when there is no file
+func loadPersisted(file string) (*persistentState, error) {
+	persisted := newPersistentState()
+	if file == "" {
+		return persisted, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return persisted, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, persisted); err != nil {
+		return nil, err
+	}
+	if persisted.Energy == nil {
+		persisted.Energy = make(map[string]float64)
+	}
+	if persisted.Faults == nil {
+		persisted.Faults = make(map[string]time.Time)
+	}
+	return persisted, nil
+}
+
+// savePersisted writes state to file if it has changed since last save
+func savePersisted(file string, persisted *persistentState) error {
+	if file == "" || !persisted.dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(persisted, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to temporary file first so a crash can not leave a truncated state
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".vallox-state")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return err
+	}
+	persisted.dirty = false
+	return nil
+}
+
+// saveState saves state of the gateway to STATE_FILE
+func (g *Gateway) saveState() {
+	if err := savePersisted(g.stateFile, g.state); err != nil {
+		logError.Printf("cannot save state: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPersistedSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "state.json")
+
+	state, err := loadPersisted(file)
+	if err != nil {
+		t.Fatalf("expected missing file to give empty state, got %v", err)
+	}
+	if state.Energy == nil || state.Faults == nil {
+		t.Fatalf("expected maps of empty state to be created")
+	}
+
+	reset := time.Date(2024, 3, 12, 12, 0, 0, 0, time.UTC)
+	state.Energy["fan"] = 12.5
+	state.ServiceReset = reset
+	state.Faults["outdoorSensor"] = reset
+	state.Spike = &spikeSettings{Rise: 8}
+
+	// unchanged state is not written
+	if err := savePersisted(file, state); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Fatalf("expected unchanged state not to be saved, got %v", files)
+	}
+
+	state.dirty = true
+	if err := savePersisted(file, state); err != nil {
+		t.Fatal(err)
+	}
+	if state.dirty {
+		t.Errorf("expected saved state not to be dirty")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+		t.Errorf("expected only state file after save, got %v", files)
+	}
+
+	loaded, err := loadPersisted(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Energy["fan"] != 12.5 || !loaded.ServiceReset.Equal(reset) || !loaded.Faults["outdoorSensor"].Equal(reset) ||
+		loaded.Spike == nil || loaded.Spike.Rise != 8 {
+		t.Errorf("expected saved state to be loaded, got %+v", loaded)
+	}
+}
+
+func TestPersistedLoadInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	if err := ioutil.WriteFile(file, []byte(`{"energy": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPersisted(file); err == nil {
+		t.Errorf("expected truncated state file to fail")
+	}
+
+	// old state without maps
+	if err := ioutil.WriteFile(file, []byte(`{"serviceReset": "2024-03-12T12:00:00Z"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadPersisted(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Energy == nil || state.Faults == nil {
+		t.Errorf("expected maps of old state to be created")
+	}
+}
+
+func TestSaveStateWithoutFile(t *testing.T) {
+	g, _, _ := newTestGateway()
+	g.state.dirty = true
+	g.saveState()
+	if !g.state.dirty {
+		t.Errorf("expected state not to be saved without state file")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import "time"
+
+// Fan speed priority arbitrates between the controllers.  Each controller reports the
+// speed it wants while it is active and the highest priority request wins: boost, humidity
+// spike, night cooling, demand control, schedule and last the speed set manually.  Frost
+// protection caps the winning speed, boost included.  Speed is sent only when the winning
+// request changes, so a manual change is kept until a controller starts, ends or changes
+// its request.  Manual speed follows the speed of the unit while no controller is active.
+
+const (
+	speedSourceBoost    = "boost"
+	speedSourceFrost    = "frost protection"
+	speedSourceSpike    = "humidity spike"
+	speedSourceCooling  = "night cooling"
+	speedSourceDemand   = "demand control"
+	speedSourceSchedule = "schedule"
+	speedSourceManual   = "manual"
+
+	// speed reported by the unit is not taken as manual speed this soon after a change
+	speedSettleTime = 30 * time.Second
+)
+
+// speedRequest is the speed a source wants, speed is 0 when the source is not active.
+// Name tells apart requests of the same speed, for example schedule slots.
+type speedRequest struct {
+	source string
+	speed  byte
+	name   string
+}
+
+// currentRequests returns current requests of all sources in priority order
+func (g *Gateway) currentRequests() []speedRequest {
+	return []speedRequest{
+		g.boost.speedRequest(),
+		g.spike.speedRequest(),
+		g.cooling.speedRequest(),
+		g.demand.speedRequest(),
+		g.schedule.speedRequest(),
+		{source: speedSourceManual, speed: g.manualSpeed},
+	}
+}
+
+// winningSpeed returns the highest priority active request
+func winningSpeed(requests []speedRequest) speedRequest {
+	for _, request := range requests {
+		if request.speed > 0 {
+			return request
+		}
+	}
+	return speedRequest{}
+}
+
+// arbitrateSpeed sends speed of the winning request, capped by frost protection, when it has changed
+func (g *Gateway) arbitrateSpeed() {
+	winner := g.frost.cap(winningSpeed(g.currentRequests()))
+	previous := g.speedWinner
+	if winner == previous {
+		return
+	}
+	g.speedWinner = winner
+
+	if winner.speed == 0 {
+		return
+	}
+	if winner.source == speedSourceManual && (previous.source == speedSourceManual || previous.source == "") {
+		return // manual requests are sent as they are made
+	}
+	logInfo.Printf("%s sets speed %d", winner.source, winner.speed)
+	g.queueSpeed(winner.speed)
+}
+
+// trackManualSpeed takes speed reported by the unit as manual speed while no controller
+// is active, so changes made from the control panel are restored after controllers
+func (g *Gateway) trackManualSpeed(speed byte, now time.Time) {
+	if g.speedWinner.source != "" && g.speedWinner.source != speedSourceManual {
+		return
+	}
+	if now.Sub(g.updateSpeedRequested) < speedSettleTime {
+		return // our own change may not have reached the unit yet
+	}
+	g.manualSpeed = speed
+	g.speedWinner = speedRequest{source: speedSourceManual, speed: speed}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newSpeedTestGateway returns gateway with controller speeds configured
+func newSpeedTestGateway() *Gateway {
+	g, _, _ := newTestGateway()
+	g.frost.speed, g.spike.speed, g.cooling.speed = 1, 6, 7
+	return g
+}
+
+// expectSpeed checks the speed sent by arbitration, 0 when nothing should be sent
+func expectSpeed(t *testing.T, g *Gateway, step string, expected byte) {
+	t.Helper()
+	g.arbitrateSpeed()
+	select {
+	case speed := <-g.speedSend:
+		if speed != expected {
+			t.Errorf("%s: expected speed %d, got %d", step, expected, speed)
+		}
+	default:
+		if expected != 0 {
+			t.Errorf("%s: expected speed %d, nothing was sent", step, expected)
+		}
+	}
+}
+
+func TestWinningSpeed(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests []speedRequest
+		expected string
+	}{
+		{"none", []speedRequest{{source: speedSourceBoost}, {source: speedSourceManual}}, ""},
+		{"first active", []speedRequest{{source: speedSourceBoost}, {source: speedSourceFrost, speed: 1}, {source: speedSourceManual, speed: 3}}, speedSourceFrost},
+		{"manual", []speedRequest{{source: speedSourceSchedule}, {source: speedSourceManual, speed: 3}}, speedSourceManual},
+	}
+	for _, test := range tests {
+		if winner := winningSpeed(test.requests); winner.source != test.expected {
+			t.Errorf("%s: expected %q to win, got %q", test.name, test.expected, winner.source)
+		}
+	}
+}
+
+func TestCoolingEndsToActiveScheduleSlot(t *testing.T) {
+	g := newSpeedTestGateway()
+	g.schedule.request = speedRequest{source: speedSourceSchedule, speed: 3, name: "slot 1320"}
+	expectSpeed(t, g, "schedule", 3)
+
+	g.cooling.active = true
+	expectSpeed(t, g, "cooling starts", 7)
+
+	// slot boundary during cooling does not override cooling
+	g.schedule.request = speedRequest{source: speedSourceSchedule, speed: 4, name: "slot 420"}
+	expectSpeed(t, g, "slot changes during cooling", 0)
+
+	g.cooling.active = false
+	expectSpeed(t, g, "cooling ends", 4)
+}
+
+func TestSpikeEndsToCurrentDemand(t *testing.T) {
+	g := newSpeedTestGateway()
+	g.demand.speed = 3
+	expectSpeed(t, g, "demand", 3)
+
+	g.spike.active = true
+	expectSpeed(t, g, "spike starts", 6)
+
+	g.demand.speed = 4
+	expectSpeed(t, g, "demand changes during spike", 0)
+
+	g.spike.active = false
+	expectSpeed(t, g, "spike ends", 4)
+}
+
+func TestBoostEndsToManualSpeed(t *testing.T) {
+	g := newSpeedTestGateway()
+	g.trackManualSpeed(2, time.Now())
+	expectSpeed(t, g, "unit speed", 0)
+
+	g.state.Boost = &boostState{Until: time.Now().Add(time.Hour), Speed: 8}
+	expectSpeed(t, g, "boost starts", 8)
+
+	g.state.Boost = nil
+	expectSpeed(t, g, "boost ends", 2)
+}
+
+func TestFrostCapsBoost(t *testing.T) {
+	g := newSpeedTestGateway()
+	g.trackManualSpeed(2, time.Now())
+
+	g.state.Boost = &boostState{Until: time.Now().Add(time.Hour), Speed: 8}
+	expectSpeed(t, g, "boost starts", 8)
+
+	// frost protection caps an active boost
+	g.frost.active = true
+	expectSpeed(t, g, "frost during boost", 1)
+
+	// boost started during frost protection is capped too
+	g.state.Boost = &boostState{Until: time.Now().Add(time.Hour), Speed: 7}
+	expectSpeed(t, g, "new boost during frost", 0)
+
+	g.frost.active = false
+	expectSpeed(t, g, "frost ends during boost", 7)
+
+	g.state.Boost = nil
+	expectSpeed(t, g, "boost ends", 2)
+}
+
+func TestManualSpeedKeptUntilRequestChanges(t *testing.T) {
+	g := newSpeedTestGateway()
+	g.schedule.request = speedRequest{source: speedSourceSchedule, speed: 3, name: "slot 420"}
+	expectSpeed(t, g, "schedule", 3)
+
+	g.requestSpeed(5)
+	expectSpeed(t, g, "manual change", 5)
+	expectSpeed(t, g, "same schedule slot", 0)
+
+	// same speed in the next slot is applied again
+	g.schedule.request = speedRequest{source: speedSourceSchedule, speed: 3, name: "slot 960"}
+	expectSpeed(t, g, "next slot", 3)
+}
+
+// TestFrostCapsControllers checks that controller requests above frost speed are capped
+func TestFrostCapsControllers(t *testing.T) {
+	tests := []struct {
+		name    string
+		request func(g *Gateway)
+	}{
+		{"schedule", func(g *Gateway) {
+			g.schedule.request = speedRequest{source: speedSourceSchedule, speed: 4, name: "slot 420"}
+		}},
+		{"demand", func(g *Gateway) { g.demand.speed = 5 }},
+		{"spike", func(g *Gateway) { g.spike.active = true }},
+		{"cooling", func(g *Gateway) { g.cooling.active = true }},
+	}
+	for _, test := range tests {
+		g := newSpeedTestGateway()
+		g.frost.active = true
+		test.request(g)
+		expectSpeed(t, g, test.name+" during frost", 1)
+		if g.updateSpeed != 1 {
+			t.Errorf("%s: expected speed limited to 1, got %d", test.name, g.updateSpeed)
+		}
+
+		// speeds queued directly are limited too
+		g.queueSpeed(6)
+		if speed := <-g.speedSend; speed != 1 {
+			t.Errorf("%s: expected queued speed to be limited to 1, got %d", test.name, speed)
+		}
+	}
+}
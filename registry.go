@@ -0,0 +1,597 @@
+package main
+
+import (
+	mqttClient "github.com/eclipse/paho.mqtt.golang"
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+// registerEntity is a value decoded from a bus register.  Value is the register value, or
+// with flag the state of that bit, or with low a 16 bit word where register holds the
+// upper and low the lower byte.  Entities with component are announced to Home Assistant
+// from ha with device and topics filled in, set makes the entity writable from topic/set.
+type registerEntity struct {
+	register  byte
+	flag      byte
+	low       byte
+	topic     string
+	component string
+	ha        haEntity
+	set       func(g *Gateway, mqtt mqttClient.Client, msg mqttClient.Message)
+}
+
+// registry contains every value published from bus registers, publishing, subscriptions
+// and discovery of register values are derived from it
+var registry = []registerEntity{
+	{
+		register: vallox.RegisterIO07,
+		topic:    topicIO7Raw,
+	},
+	{
+		register:  vallox.RegisterIO07,
+		flag:      vallox.IO07FlagReheating,
+		topic:     topicIO7Reheating,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_io7_reheating", Name: "Jälkilämmitys", DeviceClass: "heat"},
+	},
+	{
+		register: vallox.RegisterIO08,
+		topic:    topicIO8Raw,
+	},
+	{
+		register:  vallox.RegisterIO08,
+		flag:      vallox.IO08FlagSummerMode,
+		topic:     topicIO8SummerMode,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_io8_summer_mode", Name: "Peltimoottorin asento (kesä)"},
+	},
+	{
+		register:  vallox.RegisterIO08,
+		flag:      vallox.IO08FlagErrorRelay,
+		topic:     topicIO8ErrorRelay,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_io8_error_relay", Name: "Vikatietorele"},
+	},
+	{
+		register:  vallox.RegisterIO08,
+		flag:      vallox.IO08FlagMotorIn,
+		topic:     topicIO8MotorIn,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_io8_flag_motor_in", Name: "Tulopuhallin"},
+	},
+	{
+		register:  vallox.RegisterIO08,
+		flag:      vallox.IO08FlagPreheating,
+		topic:     topicIO8Preheating,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_io8_preheating", Name: "Etulämmitys", DeviceClass: "heat"},
+	},
+	{
+		register:  vallox.RegisterIO08,
+		flag:      vallox.IO08FlagMotorOut,
+		topic:     topicIO8MotorOut,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_io8_motor_out", Name: "Poistopuhallin"},
+	},
+	{
+		register:  vallox.RegisterIO08,
+		flag:      vallox.IO08FlagFireplaceSwitch,
+		topic:     topicIO8FireplaceSwitch,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_io8_fireplace_switch", Name: "Takka/tehostuskytkin"},
+	},
+	{
+		register:  vallox.RegisterCurrentFanSpeed,
+		topic:     topicFanCurrentSpeed,
+		component: "number",
+		ha:        haEntity{UniqueId: "vallox_current_fan_speed", Name: "Nykyinen puhallinnopeus", Icon: "mdi:fan", haRange: &haRange{Min: 1, Max: 8, Mode: "slider"}},
+		set:       (*Gateway).changeSpeedMessage,
+	},
+	{
+		register:  vallox.RegisterMaxRH,
+		topic:     topicRHMax,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_rh_max", Name: "Nykyinen maksimi ilmankosteus", DeviceClass: "humidity", UnitOfMeasurement: "%"},
+	},
+	{
+		register: vallox.RegisterCurrentCO2,
+		topic:    topicCO2Current,
+	},
+	{
+		register:  vallox.RegisterCurrentCO2,
+		low:       vallox.RegisterMaximumCO2,
+		topic:     topicCO2Ppm,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_co2", Name: "Hiilidioksidipitoisuus", DeviceClass: "carbon_dioxide", StateClass: "measurement", UnitOfMeasurement: "ppm"},
+	},
+	{
+		register: vallox.RegisterMaximumCO2,
+		topic:    topicCO2Max,
+	},
+	{
+		register: vallox.RegisterCO2Status,
+		topic:    topicCO2SensorRaw,
+	},
+	{
+		register:  vallox.RegisterCO2Status,
+		flag:      vallox.CO2Sensor1,
+		topic:     topicCO2Sensor1,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_co2_status_1", Name: "CO2 anturi 1"},
+	},
+	{
+		register:  vallox.RegisterCO2Status,
+		flag:      vallox.CO2Sensor2,
+		topic:     topicCO2Sensor2,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_co2_status_2", Name: "CO2 anturi 2"},
+	},
+	{
+		register:  vallox.RegisterCO2Status,
+		flag:      vallox.CO2Sensor3,
+		topic:     topicCO2Sensor3,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_co2_status_3", Name: "CO2 anturi 3"},
+	},
+	{
+		register:  vallox.RegisterCO2Status,
+		flag:      vallox.CO2Sensor4,
+		topic:     topicCO2Sensor4,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_co2_status_4", Name: "CO2 anturi 4"},
+	},
+	{
+		register:  vallox.RegisterCO2Status,
+		flag:      vallox.CO2Sensor5,
+		topic:     topicCO2Sensor5,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_co2_status_5", Name: "CO2 anturi 5"},
+	},
+	{
+		register:  vallox.RegisterMessage,
+		topic:     topicMessage,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_message", Name: "Milliampeeri-/jänniteviesti"},
+	},
+	{
+		register:  vallox.RegisterRH1,
+		topic:     topicRH1,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_rh_1", Name: "%RH #1", DeviceClass: "humidity", UnitOfMeasurement: "%"},
+	},
+	{
+		register:  vallox.RegisterRH2,
+		topic:     topicRH2,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_rh_2", Name: "%RH #2", DeviceClass: "humidity", UnitOfMeasurement: "%"},
+	},
+	{
+		register:  vallox.RegisterOutdoorTemp,
+		topic:     topicTempOutdoor,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_temp_outdoor", Name: "Ulkolämpötila", DeviceClass: "temperature", UnitOfMeasurement: "°C"},
+	},
+	{
+		register:  vallox.RegisterExhaustOutTemp,
+		topic:     topicTempExhaustOut,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_temp_exhaust_out", Name: "Jäteilman lämpötila", DeviceClass: "temperature", UnitOfMeasurement: "°C"},
+	},
+	{
+		register:  vallox.RegisterExhaustInTemp,
+		topic:     topicTempExhaustIn,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_temp_exhaust_in", Name: "Poistoilman lämpötila", DeviceClass: "temperature", UnitOfMeasurement: "°C"},
+	},
+	{
+		register:  vallox.RegisterSupplyTemp,
+		topic:     topicTempSupply,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_temp_supply", Name: "Tuloilman lämpötila", DeviceClass: "temperature", UnitOfMeasurement: "°C"},
+	},
+	{
+		register: vallox.RegisterFaultCode,
+		topic:    topicFaultRaw,
+	},
+	{
+		register:  vallox.RegisterFaultCode,
+		flag:      vallox.FaultSupplyAirSensorFault,
+		topic:     topicFaultSupplySensor,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_fault_supply_sensor", Name: "Tuloilma-anturivika", DeviceClass: "problem"},
+	},
+	{
+		register:  vallox.RegisterFaultCode,
+		flag:      vallox.FaultCarbonDioxideAlarm,
+		topic:     topicFaultCO2Alarm,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_fault_co2_alarm", Name: "Hiilidioksidihälytys", DeviceClass: "problem"},
+	},
+	{
+		register:  vallox.RegisterFaultCode,
+		flag:      vallox.FaultOutdoorSensorFault,
+		topic:     topicFaultOutdoorSensor,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_fault_outdoor_sensor", Name: "Ulkoilma-anturivika", DeviceClass: "problem"},
+	},
+	{
+		register:  vallox.RegisterFaultCode,
+		flag:      vallox.FaultExhaustAirInSensorFault,
+		topic:     topicFaultExhaustInSensor,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_fault_exhaust_in", Name: "Poistoilma-anturivika", DeviceClass: "problem"},
+	},
+	{
+		register:  vallox.RegisterFaultCode,
+		flag:      vallox.FaultWaterCoilFreezing,
+		topic:     topicFaultWaterCoilFreezing,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_fault_water_coil_freezing", Name: "Vesipatterin jäätymisvaara", DeviceClass: "problem"},
+	},
+	{
+		register:  vallox.RegisterFaultCode,
+		flag:      vallox.FaultExhaustAirOutSensorFault,
+		topic:     topicFaultExhaustOutSensor,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_fault_exhaust_out", Name: "Jäteilma-anturivika", DeviceClass: "problem"},
+	},
+	{
+		register:  vallox.RegisterPostHeatingOnTime,
+		topic:     topicPostHeatingOnTime,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_post_heating_on_time", Name: "Jälilämmityksen ON-laskuri"},
+	},
+	{
+		register:  vallox.RegisterPostHeatingOffTime,
+		topic:     topicPostHeatingOffTime,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_post_heating_off_time", Name: "Jälkilämmityksen OFF-aika"},
+	},
+	{
+		register: vallox.RegisterFlags02,
+		topic:    topicFlags2Raw,
+	},
+	{
+		register:  vallox.RegisterFlags02,
+		flag:      vallox.Flags2CO2HigherSpeedReq,
+		topic:     topicFlags2CO2HigherSpeedReq,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_flags2_co2_higher_speed_req", Name: "CO2 suurempi nopeus -pyyntö"},
+	},
+	{
+		register:  vallox.RegisterFlags02,
+		flag:      vallox.Flags2CO2LowerSpeedReq,
+		topic:     topicFlags2CO2LowerSpeedReq,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_flags2_co2_lower_speed_req", Name: "CO2 pienempi nopeus -pyyntö"},
+	},
+	{
+		register:  vallox.RegisterFlags02,
+		flag:      vallox.Flags2RHLowerSpeedReq,
+		topic:     topicFlags2RHLowerSpeedReq,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_flags2_rh_lower_speed_req", Name: "%RH pienempi nopeus -pyyntö"},
+	},
+	{
+		register:  vallox.RegisterFlags02,
+		flag:      vallox.Flags2SwitchLowerSpeedReq,
+		topic:     topicFlags2SwitchLowerSpeedReq,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_flags2_switch_lower_speed_req", Name: "Kytkin pien. nop. -pyyntö"},
+	},
+	{
+		register:  vallox.RegisterFlags02,
+		flag:      vallox.Flags2CO2Alarm,
+		topic:     topicFlags2CO2Alarm,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_flags2_co2_alarm", Name: "CO2 -hälytys", DeviceClass: "problem"},
+	},
+	{
+		register:  vallox.RegisterFlags02,
+		flag:      vallox.Flags2CellFreezeAlarm,
+		topic:     topicFlags2CellFreezeAlarm,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_flags2_cell_freeze_alarm", Name: "Kennon jäätymishälytys", DeviceClass: "problem"},
+	},
+	{
+		register: vallox.RegisterFlags04,
+		topic:    topicFlags4Raw,
+	},
+	{
+		register:  vallox.RegisterFlags04,
+		flag:      vallox.Flags4WaterCoilFreezing,
+		topic:     topicFlags4WaterCoilFreezing,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_flags4_water_coil_freezing_alert", Name: "Vesipatterin jäätymisvaara", DeviceClass: "problem"},
+	},
+	{
+		register:  vallox.RegisterFlags04,
+		flag:      vallox.Flags4Master,
+		topic:     topicFlags4Master,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_flags4_master", Name: "slave(false)/master(true) valinta"},
+	},
+	{
+		register: vallox.RegisterFlags05,
+		topic:    topicFlags5Raw,
+	},
+	{
+		register:  vallox.RegisterFlags05,
+		flag:      vallox.Flags5PreheatingStatus,
+		topic:     topicFlags5PreheatingStatus,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_flags5_preheating_status", Name: "Etulämmityksen tilalippu"},
+	},
+	{
+		register: vallox.RegisterFlags06,
+		topic:    topicFlags6Raw,
+	},
+	{
+		register:  vallox.RegisterFlags06,
+		flag:      vallox.Flags6RemoteControl,
+		topic:     topicFlags6RemoteControl,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_flags6_remote_control", Name: "Kaukovalvontaohjaus"},
+	},
+	{
+		register:  vallox.RegisterFlags06,
+		flag:      vallox.Flags6ActivateFireplaceSwitch,
+		topic:     topicFlags6FireplaceSwitch,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_flags6_fireplace_switch_activation", Name: "Takkakykimen aktivointi"},
+	},
+	{
+		register:  vallox.RegisterFlags06,
+		flag:      vallox.Flags6FireplaceFunction,
+		topic:     topicFlags6FireplaceFuncion,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_flags6_fireplace_function_state", Name: "Takka/tehostustoiminto"},
+	},
+	{
+		register:  vallox.RegisterFireplaceCounter,
+		topic:     topicFireplaceSwitchCounter,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_fireplace_switch_counter", Name: "Takka/tehostuskytkimen laskuri"},
+	},
+	{
+		register: vallox.RegisterStatus,
+		topic:    topicStatusRaw,
+	},
+	{
+		register:  vallox.RegisterStatus,
+		flag:      vallox.StatusFlagPower,
+		topic:     topicStatusPower,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_status_power", Name: "Virtanäppäin", DeviceClass: "plug"},
+	},
+	{
+		register:  vallox.RegisterStatus,
+		flag:      vallox.StatusFlagCO2,
+		topic:     topicStatusCO2,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_status_co2_key", Name: "CO2 -näppäin"},
+	},
+	{
+		register:  vallox.RegisterStatus,
+		flag:      vallox.StatusFlagRH,
+		topic:     topicStatusRH,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_status_rh_key", Name: "%RH -näppäin"},
+	},
+	{
+		register:  vallox.RegisterStatus,
+		flag:      vallox.StatusFlagHeatingMode,
+		topic:     topicStatusPostHeatingKey,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_status_post_heating_key", Name: "Jälkilämmityksen näppäin"},
+	},
+	{
+		register:  vallox.RegisterStatus,
+		flag:      vallox.StatusFlagFilter,
+		topic:     topicStatusFilterGuard,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_status_filter_guard_led", Name: "Suodatinvahdin merkkivalo"},
+	},
+	{
+		register:  vallox.RegisterStatus,
+		flag:      vallox.StatusFlagHeating,
+		topic:     topicStatusPostHeatingLed,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_status_post_heating_led", Name: "Jälkilämmityksen merkkivalo"},
+	},
+	{
+		register:  vallox.RegisterStatus,
+		flag:      vallox.StatusFlagFault,
+		topic:     topicStatusFault,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_status_fault_led", Name: "Vian merkkivalo"},
+	},
+	{
+		register:  vallox.RegisterStatus,
+		flag:      vallox.StatusFlagService,
+		topic:     topicStatusService,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_status_service_reminder", Name: "Huoltomuistutin"},
+	},
+	{
+		register:  vallox.RegisterPostHeatingSetpoint,
+		topic:     topicPostHeatingSetpoint,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_post_heating_set_point", Name: "Jälkilämmityksen asetusarvo"},
+	},
+	{
+		register:  vallox.RegisterMaxFanSpeed,
+		topic:     topicFanMaxSpeed,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_max_fan_speed", Name: "Maksimipuhallinnopeus", Icon: "mdi:fan"},
+	},
+	{
+		register:  vallox.RegisterServiceInterval,
+		topic:     topicServiceReminderInterval,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_service_reminder_interval", Name: "Huoltomuistuttimen aikaväli", DeviceClass: "duration"},
+	},
+	{
+		register:  vallox.RegisterPreheatingTemp,
+		topic:     topicPreHeatingSwitching,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_pre_heating_switching", Name: "Etulämmityksen kytkentälämpötila", DeviceClass: "temperature", UnitOfMeasurement: "°C"},
+	},
+	{
+		register: vallox.RegisterSupplyFanStopTemp,
+		topic:    topicSupplyFanStop,
+	},
+	{
+		register:  vallox.RegisterDefaultFanSpeed,
+		topic:     topicFanDefaultSpeed,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_default_fan_speed", Name: "Peruspuhallinnopeus", Icon: "mdi:fan"},
+	},
+	{
+		register: vallox.RegisterProgram,
+		topic:    topicProgramRaw,
+	},
+	{
+		register:  vallox.RegisterProgram,
+		flag:      vallox.ProgramFlagAutomaticHumidity,
+		topic:     topicProgramAutomaticHumidity,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_program_automatic_humidity", Name: "Kosteustason automaattihaku"},
+	},
+	{
+		register:  vallox.RegisterProgram,
+		flag:      vallox.ProgramFlagBoostSwitch,
+		topic:     topicProgramFireplaceSwitch,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_program_fireplace_switch", Name: "tehostus(on)/takkakytkimen(off) tila"},
+	},
+	{
+		register:  vallox.RegisterProgram,
+		flag:      vallox.ProgramFlagWater,
+		topic:     topicProgramWater,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_program_water", Name: "Vesi(on)/sähköpatterimalli(off)"},
+	},
+	{
+		register:  vallox.RegisterProgram,
+		flag:      vallox.ProgramFlagCascadeControl,
+		topic:     topicProgramCascadeControl,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_program_cascade_control", Name: "Kaskadisäätö"},
+	},
+	{
+		register:  vallox.RegisterServiceCounter,
+		topic:     topicServiceReminderCounter,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_service_reminder_counter", Name: "Huoltomuistuttimen kuukausilaskuri"},
+	},
+	{
+		register:  vallox.RegisterBasicHumidity,
+		topic:     topicRHBasic,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_rh_base", Name: "Peruskosteustaso", UnitOfMeasurement: "%"},
+	},
+	{
+		register:  vallox.RegisterBypassTemp,
+		topic:     topicBypassOperating,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_cell_bypass_temp", Name: "Kennonohituksen toimintalämpötila", DeviceClass: "temperature", UnitOfMeasurement: "°C"},
+	},
+	{
+		register:  vallox.RegisterSupplyFanSetpoint,
+		topic:     topicSupplyFanControlSetpoint,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_supply_fan_control_setpoint", Name: "Tasaviratuloilmapuhaltimen säädön asetusarvo"},
+	},
+	{
+		register:  vallox.RegisterExhaustFanSetpoint,
+		topic:     topicExhaustFanControlSetpoint,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_exhaust_fan_control_setpoint", Name: "Tasavirtapoistoilmapuhaltimen säädön asetusarvo"},
+	},
+	{
+		register:  vallox.RegisterAntiFreezeHysteresis,
+		topic:     topicCellAntifreezeHysteresis,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_cell_antifreeze_hysteresis", Name: "Kennon jäätymiseneston lämpötilojen hystereesi"},
+	},
+	{
+		register: vallox.RegisterCO2SetpointUpper,
+		topic:    topicCO2ControlSetpointUpper,
+	},
+	{
+		register:  vallox.RegisterCO2SetpointUpper,
+		low:       vallox.RegisterCO2SetpointLower,
+		topic:     topicCO2ControlSetpointPpm,
+		component: "sensor",
+		ha:        haEntity{UniqueId: "vallox_co2_control_setpoint", Name: "CO2 säädön asetusarvo", DeviceClass: "carbon_dioxide", UnitOfMeasurement: "ppm"},
+	},
+	{
+		register: vallox.RegisterCO2SetpointLower,
+		topic:    topicCO2ControlSetpointLower,
+	},
+	{
+		register: vallox.RegisterProgram2,
+		topic:    topicProgram2Raw,
+	},
+	{
+		register:  vallox.RegisterProgram2,
+		flag:      vallox.Program2FlagMaximumSpeedLimit,
+		topic:     topicProgram2MaxSpeed,
+		component: "binary_sensor",
+		ha:        haEntity{UniqueId: "vallox_program2_max_speed", Name: "Maksiminopeuden rajoitus"},
+	},
+}
+
+// isWord returns true when entity combines upper and lower byte registers
+func (e registerEntity) isWord() bool {
+	return e.low != 0
+}
+
+// decode returns value of the entity from event of its register, words are combined by wordValue
+func (e registerEntity) decode(event vallox.Event) interface{} {
+	if e.flag != 0 {
+		return event.RawValue&e.flag == e.flag
+	}
+	return event.Value
+}
+
+// discoveryEntity returns Home Assistant discovery config of the entity
+func (e registerEntity) discoveryEntity() haEntity {
+	entry := e.ha
+	entry.Device = device
+	entry.StateTopic = e.topic
+	if e.set != nil {
+		entry.CommandTopic = e.topic + "/set"
+	}
+	if e.flag != 0 {
+		entry.PayloadOn = "true"
+		entry.PayloadOff = "false"
+	}
+	return entry
+}
+
+// withRegistry adds announced registry entities to discovery
+func withRegistry(entries map[string][]haEntity) map[string][]haEntity {
+	for _, e := range registry {
+		if e.component != "" {
+			entries[e.component] = append(entries[e.component], e.discoveryEntity())
+		}
+	}
+	return entries
+}
+
+// subscribeRegistry subscribes set topics of writable registry entities
+func (g *Gateway) subscribeRegistry(mqtt mqttClient.Client) {
+	for _, e := range registry {
+		if e.set != nil {
+			mqtt.Subscribe(e.topic+"/set", 0, g.handler(e.set))
+		}
+	}
+}
+
+// handler binds message handler of a registry entity to the gateway
+func (g *Gateway) handler(set func(g *Gateway, mqtt mqttClient.Client, msg mqttClient.Message)) mqttClient.MessageHandler {
+	return func(mqtt mqttClient.Client, msg mqttClient.Message) {
+		set(g, mqtt, msg)
+	}
+}
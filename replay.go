@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+// Replay feeds a bus capture from REPLAY_FILE to the gateway instead of the serial device.
+// Frames are replayed with their recorded timing divided by REPLAY_SPEED, 0 replays as
+// fast as the gateway handles them.  Frame is for me when its destination was recorded
+// for me.  Commands to the device are logged and dropped.  Frames captured without
+// decoded value get raw value as value.  Invalid lines are logged and skipped.
+//
+// Replay only feeds frames, the gateway still runs on the wall clock.  Received values get
+// the time they are replayed, not the captured time, and time based features (schedule,
+// boost expiry, spike, cooling and frost trends, energy, history, state debounce, bus
+// statistics and notifications) follow the wall clock.  They are reproducible only with
+// REPLAY_SPEED 1 and a schedule depending on the time of day only when replayed at the
+// same time of day.
+
+type replayFrame struct {
+	time  time.Time
+	event vallox.Event
+}
+
+type replayBus struct {
+	frames []replayFrame
+	forMe  map[byte]bool
+	events chan vallox.Event
+}
+
+func openReplay() valloxBus {
+	f, err := os.Open(config.ReplayFile)
+	if err != nil {
+		logError.Fatalf("cannot open replay file: %v", err)
+	}
+	defer f.Close()
+
+	bus, err := loadReplay(config.ReplayFile, f)
+	if err != nil {
+		logError.Fatalf("cannot read replay file: %v", err)
+	}
+
+	logInfo.Printf("replaying %d frames from %s at speed %v", len(bus.frames), config.ReplayFile, config.ReplaySpeed)
+	if config.ReplaySpeed != 1 {
+		logInfo.Printf("time based features run on the wall clock and do not follow the replay speed")
+	}
+	go bus.run()
+	return bus
+}
+
+// loadReplay reads frames of capture, invalid lines are skipped
+func loadReplay(name string, r io.Reader) (*replayBus, error) {
+	bus := &replayBus{forMe: make(map[byte]bool), events: make(chan vallox.Event)}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		frame, forMe, err := parseCapture(text)
+		if err != nil {
+			logError.Printf("skipping invalid replay file %s line %d: %v", name, line, err)
+			continue
+		}
+		if forMe {
+			bus.forMe[frame.event.Destination] = true
+		}
+		bus.frames = append(bus.frames, frame)
+	}
+	return bus, scanner.Err()
+}
+
+// parseCapture parses capture line written by formatCapture
+func parseCapture(line string) (replayFrame, bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 6 {
+		return replayFrame{}, false, fmt.Errorf("expected at least 6 fields, got %d", len(fields))
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return replayFrame{}, false, fmt.Errorf("invalid time %s", fields[0])
+	}
+
+	var values [4]byte
+	for i := range values {
+		value, err := strconv.ParseUint(fields[i+1], 16, 8)
+		if err != nil {
+			return replayFrame{}, false, fmt.Errorf("invalid hex byte %s", fields[i+1])
+		}
+		values[i] = byte(value)
+	}
+
+	e := vallox.Event{Source: values[0], Destination: values[1], Register: values[2], RawValue: values[3], Value: int16(values[3])}
+	if len(fields) > 6 {
+		value, err := parseCaptureValue(fields[6])
+		if err != nil {
+			return replayFrame{}, false, err
+		}
+		if value != nil {
+			e.Value = value
+		}
+	}
+
+	return replayFrame{time: t, event: e}, fields[5] == "1", nil
+}
+
+// parseCaptureValue parses value written by formatCaptureValue, nil when value was not
+// captured.  Integers are decoded as int16 like values of the bus.
+func parseCaptureValue(field string) (interface{}, error) {
+	switch field {
+	case "-":
+		return nil, nil
+	case "true", "false":
+		return field == "true", nil
+	}
+	if value, err := strconv.ParseInt(field, 10, 16); err == nil {
+		return int16(value), nil
+	}
+	if value, err := strconv.ParseFloat(field, 64); err == nil && strings.ContainsAny(field, ".eE") {
+		return value, nil
+	}
+	return nil, fmt.Errorf("invalid value %s", field)
+}
+
+func (b *replayBus) run() {
+	var previous time.Time
+	for _, frame := range b.frames {
+		if config.ReplaySpeed > 0 && !previous.IsZero() {
+			time.Sleep(time.Duration(float64(frame.time.Sub(previous)) / config.ReplaySpeed))
+		}
+		previous = frame.time
+		b.events <- frame.event
+	}
+	logInfo.Printf("replay of %s finished", config.ReplayFile)
+}
+
+func (b *replayBus) Events() <-chan vallox.Event {
+	return b.events
+}
+
+func (b *replayBus) ForMe(e vallox.Event) bool {
+	return b.forMe[e.Destination]
+}
+
+func (b *replayBus) SetSpeed(speed byte) {
+	logInfo.Printf("replay: ignoring speed change to %d", speed)
+}
+
+func (b *replayBus) Query(register byte) {
+	logDebug.Printf("replay: ignoring query of register %x", register)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+// TestCaptureReplay checks that frames written by capture are replayed as captured
+func TestCaptureReplay(t *testing.T) {
+	start := time.Date(2023, 2, 11, 20, 5, 31, 123456789, time.FixedZone("EET", 2*60*60))
+	frames := []struct {
+		event vallox.Event
+		forMe bool
+	}{
+		{vallox.Event{Source: 0x11, Destination: 0x22, Register: vallox.RegisterOutdoorTemp, RawValue: 0x8a, Value: int16(22)}, true},
+		{vallox.Event{Source: 0x11, Destination: 0x21, Register: vallox.RegisterOutdoorTemp, RawValue: 0x20, Value: int16(-12)}, false},
+		{vallox.Event{Source: 0x11, Destination: 0x22, Register: vallox.RegisterIO08, RawValue: 0x02, Value: true}, true},
+		{vallox.Event{Source: 0x11, Destination: 0x22, Register: vallox.RegisterRH1, RawValue: 0x64, Value: 35.5}, true},
+		{vallox.Event{Source: 0x11, Destination: 0x22, Register: vallox.RegisterMessage, RawValue: 0x05, Value: nil}, true},
+	}
+
+	var capture strings.Builder
+	capture.WriteString("# time source destination register raw forme value\n")
+	for i, frame := range frames {
+		capture.WriteString(formatCapture(frame.event, frame.forMe, start.Add(time.Duration(i)*time.Second)))
+		if i == 1 {
+			capture.WriteString("2023-02-11T20:05:32+02:00 11 zz 32 8a 1 22\n")
+		}
+	}
+
+	bus, err := loadReplay("capture", strings.NewReader(capture.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bus.frames) != len(frames) {
+		t.Fatalf("expected %d frames, invalid line skipped, got %d", len(frames), len(bus.frames))
+	}
+	for i, frame := range frames {
+		got := bus.frames[i]
+		want := frame.event
+		if want.Value == nil {
+			want.Value = int16(want.RawValue)
+		}
+		if got.event != want {
+			t.Errorf("frame %d: expected %+v, got %+v", i, want, got.event)
+		}
+		if !got.time.Equal(start.Add(time.Duration(i) * time.Second)) {
+			t.Errorf("frame %d: expected time %v, got %v", i, start.Add(time.Duration(i)*time.Second), got.time)
+		}
+		if bus.ForMe(got.event) != frame.forMe {
+			t.Errorf("frame %d: expected for me %v", i, frame.forMe)
+		}
+	}
+}
+
+func TestParseCaptureInvalid(t *testing.T) {
+	for _, line := range []string{
+		"2023-02-11T20:05:31+02:00 11 22 32 8a",
+		"yesterday 11 22 32 8a 1 22",
+		"2023-02-11T20:05:31+02:00 11 22 32 8a 1 warm",
+		"2023-02-11T20:05:31+02:00 11 22 32 8a 1 70000",
+	} {
+		if _, _, err := parseCapture(line); err == nil {
+			t.Errorf("expected %q to be invalid", line)
+		}
+	}
+}
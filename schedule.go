@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mqttClient "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Weekly fan speed schedule configured with SCHEDULE, for example
+// "mon-fri 07:00 4,sat-sun 09:00 4,mon-sun 16:00 5,mon-sun 19:00 4,mon-sun 22:00 3".
+// Each entry sets the speed from its start time until the next entry.
+//
+// Speed is only sent when the active slot or override changes, so manual changes
+// are kept until the next slot starts.  Hold suspends the schedule completely,
+// schedule has the lowest priority of the controllers setting the speed.
+
+const (
+	topicScheduleSlot        = "vallox/schedule/slot"
+	topicScheduleSpeed       = "vallox/schedule/speed"
+	topicScheduleOverride    = "vallox/schedule/override"
+	topicScheduleOverrideSet = "vallox/schedule/override/set"
+	topicScheduleHold        = "vallox/schedule/hold"
+	topicScheduleHoldSet     = "vallox/schedule/hold/set"
+
+	scheduleInterval = 30 * time.Second
+
+	minutesPerDay = 24 * 60
+)
+
+var scheduleDays = map[string]int{"mon": 0, "tue": 1, "wed": 2, "thu": 3, "fri": 4, "sat": 5, "sun": 6}
+
+type scheduleSlot struct {
+	minute int // minute of week starting from monday 00:00
+	speed  byte
+	name   string
+}
+
+type scheduleOverride struct {
+	speed byte
+	until time.Time
+}
+
+// scheduleController requests speed of the active slot or override
+type scheduleController struct {
+	slots    []scheduleSlot
+	hold     bool
+	override *scheduleOverride
+	request  speedRequest
+
+	overrides chan string
+	holds     chan bool
+}
+
+// newSchedule parses SCHEDULE, schedule is disabled when not configured
+func newSchedule(c Config, discovery map[string][]haEntity) *scheduleController {
+	slots, err := parseSchedule(c.Schedule)
+	if err != nil {
+		logError.Fatalf("invalid schedule %v: %v", c.Schedule, err)
+	}
+	s := &scheduleController{
+		slots:     slots,
+		request:   speedRequest{source: speedSourceSchedule},
+		overrides: make(chan string, 10),
+		holds:     make(chan bool, 10),
+	}
+	if !s.enabled() {
+		return s
+	}
+
+	logInfo.Printf("fan speed schedule with %d slots", len(s.slots))
+
+	discovery["sensor"] = append(discovery["sensor"],
+		haEntity{
+			UniqueId:   "vallox_schedule_slot",
+			Name:       "Aikataulun jakso",
+			Device:     device,
+			Icon:       "mdi:calendar-clock",
+			StateTopic: topicScheduleSlot,
+		},
+		haEntity{
+			UniqueId:   "vallox_schedule_speed",
+			Name:       "Aikataulun nopeus",
+			Device:     device,
+			Icon:       "mdi:fan-clock",
+			StateTopic: topicScheduleSpeed,
+		},
+	)
+	discovery["switch"] = append(discovery["switch"],
+		haEntity{
+			UniqueId:     "vallox_schedule_hold",
+			Name:         "Aikataulun pito",
+			Device:       device,
+			Icon:         "mdi:calendar-remove",
+			StateTopic:   topicScheduleHold,
+			CommandTopic: topicScheduleHoldSet,
+			PayloadOn:    "true",
+			PayloadOff:   "false",
+		},
+	)
+	discovery["text"] = append(discovery["text"],
+		haEntity{
+			UniqueId:     "vallox_schedule_override",
+			Name:         "Aikataulun ohitus",
+			Device:       device,
+			Icon:         "mdi:calendar-edit",
+			StateTopic:   topicScheduleOverride,
+			CommandTopic: topicScheduleOverrideSet,
+		},
+	)
+	return s
+}
+
+func (s *scheduleController) enabled() bool {
+	return len(s.slots) > 0
+}
+
+func parseSchedule(entries []string) ([]scheduleSlot, error) {
+	var slots []scheduleSlot
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("entry %q should be <days> <hh:mm> <speed>", entry)
+		}
+
+		days, err := parseScheduleDays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		start, err := time.Parse("15:04", fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid time in %q", entry)
+		}
+		speed, err := strconv.ParseUint(fields[2], 10, 8)
+		if err != nil || speed < 1 || speed > 8 {
+			return nil, fmt.Errorf("invalid speed in %q", entry)
+		}
+
+		for _, day := range days {
+			slots = append(slots, scheduleSlot{
+				minute: day*minutesPerDay + start.Hour()*60 + start.Minute(),
+				speed:  byte(speed),
+				name:   entry,
+			})
+		}
+	}
+
+	sort.SliceStable(slots, func(i, j int) bool { return slots[i].minute < slots[j].minute })
+	return slots, nil
+}
+
+// parseScheduleDays parses a single day (mon) or range of days (mon-fri, fri-mon)
+func parseScheduleDays(days string) ([]int, error) {
+	parts := strings.SplitN(strings.ToLower(days), "-", 2)
+	first, ok := scheduleDays[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("invalid day %q", parts[0])
+	}
+	last := first
+	if len(parts) == 2 {
+		if last, ok = scheduleDays[parts[1]]; !ok {
+			return nil, fmt.Errorf("invalid day %q", parts[1])
+		}
+	}
+
+	var result []int
+	for day := first; ; day = (day + 1) % 7 {
+		result = append(result, day)
+		if day == last {
+			return result, nil
+		}
+	}
+}
+
+// activeSlot returns the slot which started most recently, wrapping over week boundary
+func (s *scheduleController) activeSlot(now time.Time) scheduleSlot {
+	minute := ((int(now.Weekday())+6)%7)*minutesPerDay + now.Hour()*60 + now.Minute()
+	active := s.slots[len(s.slots)-1]
+	for _, slot := range s.slots {
+		if slot.minute > minute {
+			break
+		}
+		active = slot
+	}
+	return active
+}
+
+// update requests speed of the active slot or override
+func (s *scheduleController) update(mqtt publisher, now time.Time) {
+	if !s.enabled() {
+		return
+	}
+
+	slot := s.activeSlot(now)
+	target := slot.speed
+	applied := fmt.Sprintf("slot %d", slot.minute)
+	override := "none"
+
+	if s.override != nil && now.After(s.override.until) {
+		logInfo.Printf("schedule override expired")
+		s.override = nil
+	}
+	if s.override != nil {
+		target = s.override.speed
+		applied = fmt.Sprintf("override %d %v", s.override.speed, s.override.until)
+		override = fmt.Sprintf("%d %s", s.override.speed, s.override.until.Sub(now).Round(time.Minute))
+	}
+
+	request := speedRequest{source: speedSourceSchedule}
+	if !s.hold {
+		request.speed, request.name = target, applied
+	}
+	if request != s.request {
+		logDebug.Printf("schedule requesting speed %d (%s)", request.speed, request.name)
+		s.request = request
+	}
+
+	go publish(mqtt, topicScheduleSlot, slot.name)
+	go publish(mqtt, topicScheduleSpeed, fmt.Sprint(target))
+	go publish(mqtt, topicScheduleOverride, override)
+	go publish(mqtt, topicScheduleHold, fmt.Sprint(s.hold))
+}
+
+// speedRequest requests speed of the active slot unless schedule is on hold
+func (s *scheduleController) speedRequest() speedRequest {
+	return s.request
+}
+
+// overrideCommand handles override commands, "<speed> <duration>" or "none" to cancel
+func (s *scheduleController) overrideCommand(command string, now time.Time) {
+	fields := strings.Fields(command)
+	if len(fields) == 1 && (fields[0] == "none" || fields[0] == "cancel") {
+		logInfo.Printf("schedule override cancelled")
+		s.override = nil
+		return
+	}
+	if len(fields) != 2 {
+		logError.Printf("invalid schedule override %s, expected <speed> <duration>", command)
+		return
+	}
+	speed, err := strconv.ParseUint(fields[0], 10, 8)
+	if err != nil || speed < 1 || speed > 8 {
+		logError.Printf("invalid schedule override speed %s", fields[0])
+		return
+	}
+	duration, err := time.ParseDuration(fields[1])
+	if err != nil || duration <= 0 {
+		logError.Printf("invalid schedule override duration %s", fields[1])
+		return
+	}
+	s.override = &scheduleOverride{speed: byte(speed), until: now.Add(duration)}
+}
+
+func (s *scheduleController) subscribe(mqtt mqttClient.Client) {
+	mqtt.Subscribe(topicScheduleOverrideSet, 0, s.overrideMessage)
+	mqtt.Subscribe(topicScheduleHoldSet, 0, s.holdMessage)
+}
+
+func (s *scheduleController) overrideMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
+	s.overrides <- string(msg.Payload())
+}
+
+func (s *scheduleController) holdMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
+	body := string(msg.Payload())
+	hold, err := strconv.ParseBool(body)
+	if err != nil {
+		logError.Printf("cannot parse schedule hold from body %s", body)
+		return
+	}
+	s.holds <- hold
+}
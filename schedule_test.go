@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestSchedule(t *testing.T, entries ...string) *scheduleController {
+	t.Helper()
+	slots, err := parseSchedule(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &scheduleController{slots: slots, request: speedRequest{source: speedSourceSchedule}}
+}
+
+func TestParseScheduleDays(t *testing.T) {
+	tests := []struct {
+		days     string
+		expected []int
+	}{
+		{"mon", []int{0}},
+		{"Mon-Fri", []int{0, 1, 2, 3, 4}},
+		{"fri-mon", []int{4, 5, 6, 0}},
+		{"sun-sun", []int{6}},
+		{"monday", nil},
+		{"mon-xyz", nil},
+	}
+	for _, test := range tests {
+		days, err := parseScheduleDays(test.days)
+		if (err != nil) != (test.expected == nil) || fmt.Sprint(days) != fmt.Sprint(test.expected) {
+			t.Errorf("%s: expected %v, got %v %v", test.days, test.expected, days, err)
+		}
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, entry := range []string{
+		"mon 07:00",
+		"mon 7 4",
+		"mon 24:00 4",
+		"mon 07:00 0",
+		"mon 07:00 9",
+		"xyz 07:00 4",
+	} {
+		if _, err := parseSchedule([]string{entry}); err == nil {
+			t.Errorf("%q: expected invalid schedule", entry)
+		}
+	}
+}
+
+func TestScheduleActiveSlot(t *testing.T) {
+	s := newTestSchedule(t, "mon-fri 07:00 4", "sat-sun 09:00 3", "mon-sun 22:00 2")
+	monday := time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		at    time.Duration // from monday 00:00
+		speed byte
+		name  string
+	}{
+		{0, 2, "mon-sun 22:00 2"}, // sunday evening slot continues over week boundary
+		{6*time.Hour + 59*time.Minute, 2, "mon-sun 22:00 2"},
+		{7 * time.Hour, 4, "mon-fri 07:00 4"},
+		{21*time.Hour + 59*time.Minute, 4, "mon-fri 07:00 4"},
+		{22 * time.Hour, 2, "mon-sun 22:00 2"},
+		{27 * time.Hour, 2, "mon-sun 22:00 2"}, // overnight to tuesday
+		{31 * time.Hour, 4, "mon-fri 07:00 4"},
+		{5*24*time.Hour + 7*time.Hour, 2, "mon-sun 22:00 2"}, // saturday morning continues friday evening
+		{5*24*time.Hour + 9*time.Hour, 3, "sat-sun 09:00 3"},
+		{6*24*time.Hour + 23*time.Hour + 59*time.Minute, 2, "mon-sun 22:00 2"},
+	}
+	for _, test := range tests {
+		now := monday.Add(test.at)
+		if slot := s.activeSlot(now); slot.speed != test.speed || slot.name != test.name {
+			t.Errorf("%s: expected %s, got %+v", now.Format("Mon 15:04"), test.name, slot)
+		}
+	}
+}
+
+func TestScheduleOverrideAndHold(t *testing.T) {
+	s := newTestSchedule(t, "mon-sun 07:00 4", "mon-sun 22:00 2")
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.Local)
+	mqtt := &testPublisher{}
+
+	steps := []struct {
+		name    string
+		command string
+		hold    bool
+		at      time.Duration
+		speed   byte
+	}{
+		{"slot", "", false, 0, 4},
+		{"override", "6 1h", false, 0, 6},
+		{"invalid override is ignored", "9 1h", false, 0, 6},
+		{"override until its end", "", false, time.Hour, 6},
+		{"override expired", "", false, time.Second, 4},
+		{"new override", "5 12h", false, 0, 5},
+		{"override over slot change", "", false, 10 * time.Hour, 5},
+		{"override cancelled", "none", false, 0, 2},
+		{"hold", "", true, 0, 0},
+		{"override on hold", "6 1h", true, 0, 0},
+		{"hold released", "", false, 0, 6},
+	}
+	for _, step := range steps {
+		now = now.Add(step.at)
+		if step.command != "" {
+			s.overrideCommand(step.command, now)
+		}
+		s.hold = step.hold
+		s.update(mqtt, now)
+		if request := s.speedRequest(); request.speed != step.speed {
+			t.Errorf("%s: expected speed %d, got %+v", step.name, step.speed, request)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+// Service reminder counts months since the last service, the reminder is shown
+// when the counter reaches the service interval.  Date of the last reset is recorded
+// when the counter is seen dropping to zero.  A reset made while the gateway was not
+// running is noticed from a counter lower than the months since the recorded reset,
+// its date is then estimated from the counter.  The counter can not be reset from the
+// gateway, vallox library has no API for writing registers.
+
+const (
+	topicServiceRemainingMonths = "vallox/serviceReminder/remainingMonths"
+	topicServiceRemainingDays   = "vallox/serviceReminder/remainingDays"
+	topicServiceDue             = "vallox/serviceReminder/due"
+	topicServiceLastReset       = "vallox/serviceReminder/lastReset"
+)
+
+// updateService records counter resets and publishes remaining time when service values change
+func (g *Gateway) updateService(register byte) {
+	switch register {
+	case vallox.RegisterServiceCounter:
+		cached := g.cache[register]
+		counter := int(cached.value.RawValue)
+		if g.serviceCounter > 0 && counter == 0 {
+			logInfo.Printf("service reminder counter was reset")
+			g.recordServiceReset(cached.time)
+		} else if g.serviceCounter < 0 && cached.time.After(g.state.ServiceReset.AddDate(0, counter+1, 0)) {
+			// counter is lower than months since the recorded reset, so it was reset while we were not running
+			reset := cached.time.AddDate(0, -counter, 0)
+			logInfo.Printf("service reminder counter %d was reset while not running, estimated reset date %s", counter, reset.Format("2006-01-02"))
+			g.recordServiceReset(reset)
+		}
+		g.serviceCounter = counter
+	case vallox.RegisterServiceInterval, vallox.RegisterStatus:
+	default:
+		return
+	}
+
+	publishService(g.mqtt, g.state, g.cache, time.Now())
+}
+
+func publishService(mqtt publisher, persisted *persistentState, cache map[byte]cacheEntry, now time.Time) {
+	if !persisted.ServiceReset.IsZero() {
+		go publish(mqtt, topicServiceLastReset, persisted.ServiceReset.Format(time.RFC3339))
+	}
+
+	months, days, ok := serviceRemaining(persisted, cache, now)
+	if !ok {
+		return
+	}
+
+	due := months <= 0
+	if status, ok := cache[vallox.RegisterStatus]; ok && status.value.RawValue&vallox.StatusFlagService == vallox.StatusFlagService {
+		due = true
+	}
+
+	go publish(mqtt, topicServiceRemainingMonths, fmt.Sprint(months))
+	go publish(mqtt, topicServiceRemainingDays, fmt.Sprint(days))
+	go publish(mqtt, topicServiceDue, fmt.Sprint(due))
+}
+
+// serviceRemaining returns months and days until service, days are estimated
+// from the last reset date when known and otherwise from remaining months
+func serviceRemaining(persisted *persistentState, cache map[byte]cacheEntry, now time.Time) (int, int, bool) {
+	interval, okInterval := cache[vallox.RegisterServiceInterval]
+	counter, okCounter := cache[vallox.RegisterServiceCounter]
+	if !okInterval || !okCounter {
+		return 0, 0, false
+	}
+
+	months := int(interval.value.RawValue) - int(counter.value.RawValue)
+	if months < 0 {
+		months = 0
+	}
+
+	days := months * 30
+	if !persisted.ServiceReset.IsZero() {
+		due := persisted.ServiceReset.AddDate(0, int(interval.value.RawValue), 0)
+		days = int(math.Ceil(due.Sub(now).Hours() / 24))
+		if days < 0 {
+			days = 0
+		}
+	}
+
+	return months, days, true
+}
+
+// recordServiceReset keeps date of the last service reset in persistent state
+func (g *Gateway) recordServiceReset(reset time.Time) {
+	g.state.ServiceReset = reset
+	g.state.dirty = true
+}
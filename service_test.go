@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+func serviceCounterEvent(counter byte) vallox.Event {
+	return vallox.Event{Source: 0x11, Destination: testAddress, Register: vallox.RegisterServiceCounter, RawValue: counter, Value: int16(counter)}
+}
+
+func TestServiceResetRecorded(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		recorded time.Time
+		counters []byte
+		expected time.Time // zero when recorded date is kept
+	}{
+		{"counter drops to zero", now.AddDate(0, -13, 0), []byte{12, 0}, now},
+		{"counter increments", now.AddDate(0, -2, 10), []byte{1, 2}, time.Time{}},
+		{"startup matches recorded reset", now.AddDate(0, -2, -10), []byte{2}, time.Time{}},
+		{"reset while not running", now.AddDate(0, -13, 0), []byte{1}, now.AddDate(0, -1, 0)},
+		{"no recorded reset", time.Time{}, []byte{3}, now.AddDate(0, -3, 0)},
+	}
+	for _, test := range tests {
+		g, _, _ := newTestGateway()
+		g.state.ServiceReset = test.recorded
+		for _, counter := range test.counters {
+			g.handleValloxEvent(serviceCounterEvent(counter))
+		}
+
+		expected := test.expected
+		if expected.IsZero() {
+			expected = test.recorded
+		}
+		if diff := g.state.ServiceReset.Sub(expected); diff < -time.Minute || diff > time.Minute {
+			t.Errorf("%s: expected reset %v, got %v", test.name, expected, g.state.ServiceReset)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+// Sniff mode publishes every frame seen on the bus, including traffic between other
+// panels and the mainboard, to vallox/bus/<from>/<to>/<register> with raw value as payload.
+// Addresses and register are two digit hex.  With SNIFF_PASSIVE the gateway is passive,
+// speed changes and queries are logged and not sent to the bus, so it can listen to a bus
+// without disturbing it.
+
+const topicBusFormat = "vallox/bus/%02x/%02x/%02x"
+
+// passiveBus logs and drops all commands to the bus
+type passiveBus struct {
+	valloxBus
+}
+
+func (b passiveBus) SetSpeed(speed byte) {
+	logInfo.Printf("passive mode: not sending speed change to %d", speed)
+}
+
+func (b passiveBus) Query(register byte) {
+	logInfo.Printf("passive mode: not querying register %x", register)
+}
+
+// sniffEvent publishes raw value of a frame seen on the bus
+func sniffEvent(mqtt publisher, e vallox.Event) {
+	publish(mqtt, fmt.Sprintf(topicBusFormat, e.Source, e.Destination, e.Register), fmt.Sprintf("%d", e.RawValue))
+}
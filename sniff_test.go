@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+func TestSniffEvent(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		bus := &testBus{events: make(chan vallox.Event)}
+		mqtt := &testPublisher{}
+		g := newGateway(Config{EnableSniff: enabled}, newPersistentState(), bus)
+		g.mqtt = mqtt
+
+		frames := []vallox.Event{
+			{Source: 0x11, Destination: testAddress, Register: vallox.RegisterOutdoorTemp, RawValue: 100, Value: int16(5)},
+			{Source: 0x21, Destination: 0x11, Register: vallox.RegisterCurrentFanSpeed, RawValue: 7, Value: int16(3)},
+		}
+		for _, e := range frames {
+			g.handleValloxEvent(e)
+		}
+
+		for _, e := range frames {
+			topic := fmt.Sprintf(topicBusFormat, e.Source, e.Destination, e.Register)
+			payloads := mqtt.payloads(topic)
+			if !enabled {
+				if len(payloads) != 0 {
+					t.Errorf("expected nothing published to %s without sniff, got %v", topic, payloads)
+				}
+				continue
+			}
+			if len(payloads) != 1 || payloads[0] != fmt.Sprint(e.RawValue) {
+				t.Errorf("expected raw value %d published to %s, got %v", e.RawValue, topic, payloads)
+			}
+		}
+	}
+}
+
+func TestSniffPassive(t *testing.T) {
+	tests := []struct {
+		config Config
+		sent   bool
+	}{
+		{Config{EnableSniff: true}, true},
+		{Config{EnableSniff: true, SniffPassive: true}, false},
+		{Config{SniffPassive: true}, false},
+	}
+	for _, test := range tests {
+		bus := &testBus{events: make(chan vallox.Event)}
+		g := newGateway(test.config, newPersistentState(), bus)
+
+		g.device.SetSpeed(3)
+		g.device.Query(vallox.RegisterCurrentFanSpeed)
+
+		speeds, queries := bus.sentSpeeds(), bus.sentQueries()
+		if sent := len(speeds) == 1 && len(queries) == 1; sent != test.sent {
+			t.Errorf("%+v: expected commands sent %v, got speeds %v and queries %v", test.config, test.sent, speeds, queries)
+		}
+	}
+}
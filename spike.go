@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	mqttClient "github.com/eclipse/paho.mqtt.golang"
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+// Humidity spike detection for sauna and shower use.  Baseline follows the humidity
+// slowly as exponential moving average, a spike is detected when humidity rises above
+// the baseline by rise threshold.  Ventilation is boosted until humidity is back within
+// decay margin of the baseline.  Baseline is not updated during the spike.
+
+const (
+	topicSpikeActive    = "vallox/spike/active"
+	topicSpikeHumidity  = "vallox/spike/humidity"
+	topicSpikeBaseline  = "vallox/spike/baseline"
+	topicSpikeRise      = "vallox/spike/rise"
+	topicSpikeRiseSet   = "vallox/spike/rise/set"
+	topicSpikeDecay     = "vallox/spike/decay"
+	topicSpikeDecaySet  = "vallox/spike/decay/set"
+	topicSpikeEnabled   = "vallox/spike/enabled"
+	topicSpikeEnableSet = "vallox/spike/enabled/set"
+)
+
+// spikeSettings can be tuned at runtime, kept in persistent state
+type spikeSettings struct {
+	Rise    float64 `json:"rise"`
+	Decay   float64 `json:"decay"`
+	Enabled bool    `json:"enabled"`
+}
+
+type spikeTune struct {
+	topic string
+	value string
+}
+
+// spikeController detects humidity spikes
+type spikeController struct {
+	enabled        bool
+	sensor         *demandSensor // external humidity sensor, unit's sensors when nil
+	speed          byte
+	baselineWindow time.Duration
+	maxDuration    time.Duration
+	sensorTimeout  time.Duration
+	state          *persistentState
+
+	reading  demandReading
+	baseline float64
+	sampled  time.Time
+	started  time.Time
+	active   bool
+
+	readings chan demandReading
+	tunes    chan spikeTune
+}
+
+// newSpike creates spike detection from config, thresholds are kept in state
+func newSpike(c Config, state *persistentState, discovery map[string][]haEntity) *spikeController {
+	s := &spikeController{
+		enabled:        c.SpikeDetection,
+		speed:          c.SpikeSpeed,
+		baselineWindow: c.SpikeBaselineWindow,
+		maxDuration:    c.SpikeMaxDuration,
+		sensorTimeout:  c.DemandSensorTimeout,
+		state:          state,
+		readings:       make(chan demandReading, 10),
+		tunes:          make(chan spikeTune, 10),
+	}
+	if !s.enabled {
+		return s
+	}
+
+	if c.SpikeRHTopic != "" {
+		sensors, err := parseDemandSensors([]string{c.SpikeRHTopic})
+		if err != nil {
+			logError.Fatalf("invalid spike humidity topic: %v", err)
+		}
+		s.sensor = &sensors[0]
+	}
+
+	if c.SpikeRise <= 0 || c.SpikeDecay < 0 {
+		logError.Fatalf("SPIKE_RISE should be positive and SPIKE_DECAY not negative")
+	}
+	if state.Spike == nil {
+		state.Spike = &spikeSettings{Rise: c.SpikeRise, Decay: c.SpikeDecay, Enabled: true}
+	}
+	if state.Spike.Rise <= 0 {
+		logError.Printf("spike rise %v in state file is not positive, using %v", state.Spike.Rise, c.SpikeRise)
+		state.Spike.Rise = c.SpikeRise
+	}
+
+	logInfo.Printf("humidity spike detection, rise %.0f%% decay %.0f%%", state.Spike.Rise, state.Spike.Decay)
+
+	discovery["binary_sensor"] = append(discovery["binary_sensor"],
+		haEntity{
+			UniqueId:    "vallox_spike_active",
+			Name:        "Kosteuspiikki",
+			Device:      device,
+			DeviceClass: "moisture",
+			StateTopic:  topicSpikeActive,
+			PayloadOn:   "true",
+			PayloadOff:  "false",
+		},
+	)
+	discovery["sensor"] = append(discovery["sensor"],
+		haEntity{
+			UniqueId:          "vallox_spike_baseline",
+			Name:              "Kosteuden perustaso",
+			Device:            device,
+			DeviceClass:       "humidity",
+			StateClass:        "measurement",
+			StateTopic:        topicSpikeBaseline,
+			UnitOfMeasurement: "%",
+		},
+	)
+	discovery["number"] = append(discovery["number"],
+		haEntity{
+			UniqueId:          "vallox_spike_rise",
+			Name:              "Kosteuspiikin nousuraja",
+			Device:            device,
+			Icon:              "mdi:water-percent-alert",
+			StateTopic:        topicSpikeRise,
+			CommandTopic:      topicSpikeRiseSet,
+			UnitOfMeasurement: "%",
+			haRange:           &haRange{Min: 1, Max: 50},
+		},
+		haEntity{
+			UniqueId:          "vallox_spike_decay",
+			Name:              "Kosteuspiikin päättymisraja",
+			Device:            device,
+			Icon:              "mdi:water-percent",
+			StateTopic:        topicSpikeDecay,
+			CommandTopic:      topicSpikeDecaySet,
+			UnitOfMeasurement: "%",
+			haRange:           &haRange{Min: 0, Max: 50},
+		},
+	)
+	discovery["switch"] = append(discovery["switch"],
+		haEntity{
+			UniqueId:     "vallox_spike_enabled",
+			Name:         "Kosteuspiikin tunnistus",
+			Device:       device,
+			Icon:         "mdi:shower",
+			StateTopic:   topicSpikeEnabled,
+			CommandTopic: topicSpikeEnableSet,
+			PayloadOn:    "true",
+			PayloadOff:   "false",
+		},
+	)
+	return s
+}
+
+// humidity returns external humidity when configured, otherwise highest of unit's RH sensors
+func (s *spikeController) humidity(cache map[byte]cacheEntry, now time.Time) (float64, bool) {
+	if s.sensor != nil {
+		if s.reading.time.IsZero() || now.Sub(s.reading.time) > s.sensorTimeout {
+			return 0, false
+		}
+		return s.reading.value, true
+	}
+
+	rh1, ok1 := cachedNumber(cache, vallox.RegisterRH1)
+	rh2, ok2 := cachedNumber(cache, vallox.RegisterRH2)
+	switch {
+	case ok1 && ok2:
+		return math.Max(rh1, rh2), true
+	case ok1:
+		return rh1, true
+	case ok2:
+		return rh2, true
+	}
+	return 0, false
+}
+
+// update updates baseline and starts or ends the spike boost
+func (s *spikeController) update(mqtt publisher, cache map[byte]cacheEntry, now time.Time) {
+	if !s.enabled {
+		return
+	}
+	settings := s.state.Spike
+
+	go publish(mqtt, topicSpikeRise, fmt.Sprint(settings.Rise))
+	go publish(mqtt, topicSpikeDecay, fmt.Sprint(settings.Decay))
+	go publish(mqtt, topicSpikeEnabled, fmt.Sprint(settings.Enabled))
+
+	humidity, ok := s.humidity(cache, now)
+	if !ok {
+		return
+	}
+
+	if s.sampled.IsZero() {
+		s.baseline = humidity
+	} else if !s.active {
+		// exponential moving average over baseline window
+		alpha := 1 - math.Exp(-now.Sub(s.sampled).Seconds()/s.baselineWindow.Seconds())
+		s.baseline += (humidity - s.baseline) * alpha
+	}
+	s.sampled = now
+
+	if !s.active && settings.Enabled && humidity-s.baseline >= settings.Rise {
+		logInfo.Printf("humidity spike detected, %.0f%% baseline %.0f%%", humidity, s.baseline)
+		s.active = true
+		s.started = now
+	} else if s.active && (humidity-s.baseline <= settings.Decay || now.Sub(s.started) > s.maxDuration || !settings.Enabled) {
+		logInfo.Printf("humidity spike ended, %.0f%% baseline %.0f%%", humidity, s.baseline)
+		s.active = false
+	}
+
+	go publish(mqtt, topicSpikeHumidity, fmt.Sprintf("%.0f", humidity))
+	go publish(mqtt, topicSpikeBaseline, fmt.Sprintf("%.1f", s.baseline))
+	go publish(mqtt, topicSpikeActive, fmt.Sprint(s.active))
+}
+
+// speedRequest requests spike speed while spike is active
+func (s *spikeController) speedRequest() speedRequest {
+	request := speedRequest{source: speedSourceSpike}
+	if s.active {
+		request.speed = s.speed
+	}
+	return request
+}
+
+// tune changes spike detection settings
+func (s *spikeController) tune(tune spikeTune) {
+	switch tune.topic {
+	case topicSpikeEnableSet:
+		enabled, err := strconv.ParseBool(tune.value)
+		if err != nil {
+			logError.Printf("cannot parse spike detection enabled from body %s", tune.value)
+			return
+		}
+		s.state.Spike.Enabled = enabled
+	case topicSpikeRiseSet, topicSpikeDecaySet:
+		value, err := strconv.ParseFloat(tune.value, 64)
+		if err != nil || value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+			logError.Printf("cannot parse spike threshold from body %s", tune.value)
+			return
+		}
+		if tune.topic == topicSpikeRiseSet {
+			// zero rise would detect a spike on every update
+			if value == 0 {
+				logError.Printf("spike rise should be positive")
+				return
+			}
+			s.state.Spike.Rise = value
+		} else {
+			s.state.Spike.Decay = value
+		}
+	}
+	s.state.dirty = true
+}
+
+func (s *spikeController) subscribe(mqtt mqttClient.Client) {
+	for _, topic := range []string{topicSpikeRiseSet, topicSpikeDecaySet, topicSpikeEnableSet} {
+		mqtt.Subscribe(topic, 0, s.tuneMessage)
+	}
+}
+
+// sensorRoutes delivers readings of external humidity sensor to spike detection
+func (s *spikeController) sensorRoutes() []sensorRoute {
+	if s.sensor == nil {
+		return nil
+	}
+	return []sensorRoute{{sensor: *s.sensor, readings: s.readings}}
+}
+
+func (s *spikeController) tuneMessage(mqtt mqttClient.Client, msg mqttClient.Message) {
+	s.tunes <- spikeTune{topic: msg.Topic(), value: string(msg.Payload())}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	vallox "github.com/jokujossai/vallox-rs485"
+)
+
+func newTestSpike(state *persistentState) *spikeController {
+	return newSpike(Config{
+		SpikeDetection:      true,
+		SpikeSpeed:          6,
+		SpikeRise:           10,
+		SpikeDecay:          3,
+		SpikeBaselineWindow: 30 * time.Minute,
+		SpikeMaxDuration:    2 * time.Hour,
+	}, state, make(map[string][]haEntity))
+}
+
+func TestSpikeTune(t *testing.T) {
+	tests := []struct {
+		topic    string
+		value    string
+		expected spikeSettings
+	}{
+		{topicSpikeRiseSet, "15", spikeSettings{Rise: 15, Decay: 3, Enabled: true}},
+		{topicSpikeRiseSet, "0.5", spikeSettings{Rise: 0.5, Decay: 3, Enabled: true}},
+		{topicSpikeRiseSet, "0", spikeSettings{Rise: 10, Decay: 3, Enabled: true}},
+		{topicSpikeRiseSet, "-5", spikeSettings{Rise: 10, Decay: 3, Enabled: true}},
+		{topicSpikeRiseSet, "NaN", spikeSettings{Rise: 10, Decay: 3, Enabled: true}},
+		{topicSpikeRiseSet, "high", spikeSettings{Rise: 10, Decay: 3, Enabled: true}},
+		{topicSpikeDecaySet, "0", spikeSettings{Rise: 10, Decay: 0, Enabled: true}},
+		{topicSpikeDecaySet, "-1", spikeSettings{Rise: 10, Decay: 3, Enabled: true}},
+		{topicSpikeDecaySet, "+Inf", spikeSettings{Rise: 10, Decay: 3, Enabled: true}},
+		{topicSpikeEnableSet, "false", spikeSettings{Rise: 10, Decay: 3, Enabled: false}},
+		{topicSpikeEnableSet, "maybe", spikeSettings{Rise: 10, Decay: 3, Enabled: true}},
+	}
+	for _, test := range tests {
+		s := newTestSpike(newPersistentState())
+		s.tune(spikeTune{topic: test.topic, value: test.value})
+		if *s.state.Spike != test.expected {
+			t.Errorf("%s %s: expected %+v, got %+v", test.topic, test.value, test.expected, *s.state.Spike)
+		}
+	}
+}
+
+func TestSpikeStateRise(t *testing.T) {
+	state := newPersistentState()
+	state.Spike = &spikeSettings{Rise: 0, Decay: 2, Enabled: true}
+	s := newTestSpike(state)
+
+	if s.state.Spike.Rise != 10 || s.state.Spike.Decay != 2 {
+		t.Errorf("expected rise from config to replace zero rise in state, got %+v", *s.state.Spike)
+	}
+}
+
+func TestSpikeDetection(t *testing.T) {
+	s := newTestSpike(newPersistentState())
+	mqtt := &testPublisher{}
+	start := time.Date(2024, 1, 12, 20, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		name     string
+		at       time.Duration
+		rh1, rh2 int16
+		disable  bool
+		active   bool
+	}{
+		{"baseline", 0, 40, 38, false, false},
+		{"slow rise", time.Minute, 42, 38, false, false},
+		{"shower", 2 * time.Minute, 38, 55, false, true},
+		{"above decay margin", 10 * time.Minute, 50, 38, false, true},
+		{"within decay margin", 20 * time.Minute, 43, 38, false, false},
+		{"sauna", 30 * time.Minute, 60, 38, false, true},
+		{"maximum duration", 30*time.Minute + 2*time.Hour + time.Second, 60, 38, false, false},
+		{"disabled", 3 * time.Hour, 80, 38, true, false},
+	}
+	for _, step := range steps {
+		s.state.Spike.Enabled = !step.disable
+		cache := testCache(map[byte]int16{vallox.RegisterRH1: step.rh1, vallox.RegisterRH2: step.rh2})
+		s.update(mqtt, cache, start.Add(step.at))
+
+		speed := byte(0)
+		if step.active {
+			speed = 6
+		}
+		if s.active != step.active || s.speedRequest().speed != speed {
+			t.Errorf("%s: expected active %v, got %v with baseline %.1f", step.name, step.active, s.active, s.baseline)
+		}
+	}
+}
+
+func TestSpikeBaselineFrozen(t *testing.T) {
+	s := newTestSpike(newPersistentState())
+	mqtt := &testPublisher{}
+	start := time.Date(2024, 1, 12, 20, 0, 0, 0, time.UTC)
+
+	s.update(mqtt, testCache(map[byte]int16{vallox.RegisterRH1: 40}), start)
+	s.update(mqtt, testCache(map[byte]int16{vallox.RegisterRH1: 70}), start.Add(time.Minute))
+	baseline := s.baseline
+	s.update(mqtt, testCache(map[byte]int16{vallox.RegisterRH1: 70}), start.Add(time.Hour))
+
+	if !s.active || s.baseline != baseline {
+		t.Errorf("expected baseline %.1f not to follow humidity during spike, got %.1f", baseline, s.baseline)
+	}
+}